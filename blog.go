@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	blogDir      = flag.String("blog-dir", "blog", "directory under static/ holding blog posts; empty disables the blog")
+	blogPageSize = flag.Int("blog-page-size", 10, "number of posts on each page of the blog index")
+)
+
+// Post is a Markdown file in the blog directory
+type Post struct {
+	// URL path of the post
+	Path  string
+	File  string
+	Title string
+	Date  time.Time
+	// when the post was last changed, for feeds and sitemaps
+	Updated time.Time
+	Tags    []string
+	Meta    FrontMatter
+}
+
+// Blog is the list of posts in the blog directory, newest first. It's
+// loaded lazily and reloaded after Invalidate.
+type Blog struct {
+	mu     sync.Mutex
+	posts  []*Post
+	loaded bool
+}
+
+var blog = &Blog{}
+
+// matches file names like 2020-06-20-some-post.md
+var datedFileName = regexp.MustCompile(`^(\d{4}-\d{2}-\d{2})-(.*)\.md$`)
+
+// Invalidate makes the next call to Posts rescan the blog directory
+func (b *Blog) Invalidate() {
+	b.mu.Lock()
+	b.loaded = false
+	b.mu.Unlock()
+}
+
+// Posts returns the published posts, newest first
+func (b *Blog) Posts() []*Post {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.loaded || DEBUG {
+		posts, err := loadPosts(strings.Trim(*blogDir, "/"))
+		if err != nil {
+			log.Printf("[ERR] unable to load blog posts: %v", err)
+		}
+		b.posts = posts
+		b.loaded = true
+	}
+	return b.posts
+}
+
+func loadPosts(dir string) ([]*Post, error) {
+	if len(dir) == 0 {
+		return nil, nil
+	}
+	files, err := filepath.Glob(filepath.Join(STATIC_DIR, dir, "*.md"))
+	if err != nil {
+		return nil, err
+	}
+
+	posts := make([]*Post, 0, len(files))
+	for _, file := range files {
+		urlPath := "/" + filepath.ToSlash(file[len(STATIC_DIR+"/"):])
+		if isHidden(urlPath) {
+			continue
+		}
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		meta, body, err := ParseFrontMatter(b)
+		if err != nil {
+			log.Printf("[ERR] skipping blog post %s: %v", file, err)
+			continue
+		}
+		if meta.Draft {
+			continue
+		}
+
+		post := &Post{Path: urlPath, File: file, Title: meta.Title, Date: meta.Date, Tags: meta.Tags, Meta: meta}
+		name := filepath.Base(file)
+		slug := strings.TrimSuffix(name, ".md")
+		if m := datedFileName.FindStringSubmatch(name); m != nil {
+			slug = m[2]
+			if post.Date.IsZero() {
+				post.Date, _ = time.Parse("2006-01-02", m[1])
+			}
+		}
+		if post.Date.IsZero() {
+			if info, err := os.Stat(file); err == nil {
+				post.Date = info.ModTime()
+			}
+		}
+		post.Updated = meta.Updated
+		if post.Updated.IsZero() {
+			post.Updated = lastModified(file)
+		}
+		if post.Updated.Before(post.Date) {
+			post.Updated = post.Date
+		}
+		if len(post.Title) == 0 {
+			post.Title = markdownTitle(body)
+		}
+		if len(post.Title) == 0 {
+			post.Title = strings.Replace(slug, "-", " ", -1)
+		}
+		posts = append(posts, post)
+	}
+
+	sort.SliceStable(posts, func(i, j int) bool {
+		if posts[i].Date.Equal(posts[j].Date) {
+			return posts[i].Path < posts[j].Path
+		}
+		return posts[i].Date.After(posts[j].Date)
+	})
+	return posts, nil
+}
+
+// Neighbours returns the posts before and after the post at urlPath;
+// either may be nil, and both are if urlPath isn't a post
+func (b *Blog) Neighbours(urlPath string) (prev, next *Post) {
+	posts := b.Posts()
+	for i, post := range posts {
+		if post.Path != urlPath {
+			continue
+		}
+		// posts are newest first, so the previous post comes after this one
+		if i+1 < len(posts) {
+			prev = posts[i+1]
+		}
+		if i > 0 {
+			next = posts[i-1]
+		}
+		return
+	}
+	return nil, nil
+}
+
+func tagSlug(tag string) string {
+	return strings.ToLower(strings.Join(strings.Fields(tag), "-"))
+}
+
+// BlogHandler serves the generated index and tag pages of the blog, and
+// leaves everything else in the blog directory to next
+func BlogHandler(next http.Handler) http.Handler {
+	prefix := "/" + strings.Trim(*blogDir, "/") + "/"
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rest := strings.TrimPrefix(r.URL.Path, prefix)
+		parts := strings.Split(strings.Trim(rest, "/"), "/")
+
+		var title, tag string
+		pageNum := 1
+		switch {
+		case rest == "":
+			title = "Blog"
+		case parts[0] == "page" && len(parts) == 2:
+			title = "Blog"
+			pageNum, _ = strconv.Atoi(parts[1])
+		case parts[0] == "tags" && len(parts) == 1:
+			serveTagList(w, r, prefix)
+			return
+		case parts[0] == "tags" && (len(parts) == 2 || len(parts) == 4 && parts[2] == "page"):
+			tag = parts[1]
+			if len(parts) == 4 {
+				pageNum, _ = strconv.Atoi(parts[3])
+			}
+		default:
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var posts []*Post
+		for _, post := range blog.Posts() {
+			if len(tag) == 0 {
+				posts = append(posts, post)
+				continue
+			}
+			for _, t := range post.Tags {
+				if tagSlug(t) == tag {
+					posts = append(posts, post)
+					if len(title) == 0 {
+						title = "Posts tagged " + t
+					}
+					break
+				}
+			}
+		}
+		if len(tag) > 0 && len(posts) == 0 {
+			serveError(w, r, 404, "")
+			return
+		}
+
+		size := *blogPageSize
+		if size <= 0 {
+			size = len(posts) + 1
+		}
+		pages := (len(posts) + size - 1) / size
+		if pages == 0 {
+			pages = 1
+		}
+		if pageNum < 1 || pageNum > pages {
+			serveError(w, r, 404, "")
+			return
+		}
+		start := (pageNum - 1) * size
+		end := start + size
+		if end > len(posts) {
+			end = len(posts)
+		}
+
+		base := prefix
+		if len(tag) > 0 {
+			base += "tags/" + tag + "/"
+		}
+		var md bytes.Buffer
+		fmt.Fprintf(&md, "# %s\n\n", markdownEscape(title))
+		for _, post := range posts[start:end] {
+			writePostEntry(&md, post, prefix)
+		}
+		md.WriteString("\n")
+		if pageNum > 1 {
+			if pageNum == 2 {
+				fmt.Fprintf(&md, "[Newer posts](%s) ", markdownURL(base))
+			} else {
+				fmt.Fprintf(&md, "[Newer posts](%s) ", markdownURL(fmt.Sprintf("%spage/%d/", base, pageNum-1)))
+			}
+		}
+		if pageNum < pages {
+			fmt.Fprintf(&md, "[Older posts](%s)", markdownURL(fmt.Sprintf("%spage/%d/", base, pageNum+1)))
+		}
+		md.WriteString("\n")
+
+		renderPage(w, r, 200, Page{
+			Title:   title,
+			Content: template.HTML(Markdown(md.Bytes(), strings.Trim(*blogDir, "/"))),
+		})
+	})
+}
+
+func serveTagList(w http.ResponseWriter, r *http.Request, prefix string) {
+	counts := make(map[string]int)
+	names := make(map[string]string)
+	for _, post := range blog.Posts() {
+		for _, t := range post.Tags {
+			counts[tagSlug(t)]++
+			names[tagSlug(t)] = t
+		}
+	}
+	slugs := make([]string, 0, len(counts))
+	for slug := range counts {
+		slugs = append(slugs, slug)
+	}
+	sort.Strings(slugs)
+
+	var md bytes.Buffer
+	md.WriteString("# Tags\n\n")
+	for _, slug := range slugs {
+		fmt.Fprintf(&md, "- [%s](%s) (%d)\n", markdownEscape(names[slug]), markdownURL(prefix+"tags/"+slug+"/"), counts[slug])
+	}
+	renderPage(w, r, 200, Page{
+		Title:   "Tags",
+		Content: template.HTML(Markdown(md.Bytes(), strings.Trim(*blogDir, "/"))),
+	})
+}
+
+func writePostEntry(md *bytes.Buffer, post *Post, prefix string) {
+	fmt.Fprintf(md, "- **[%s](%s)** — %s", markdownEscape(post.Title), markdownURL(post.Path), post.Date.Format("January 2, 2006"))
+	for i, t := range post.Tags {
+		if i == 0 {
+			md.WriteString(" · ")
+		} else {
+			md.WriteString(", ")
+		}
+		fmt.Fprintf(md, "[%s](%s)", markdownEscape(t), markdownURL(prefix+"tags/"+tagSlug(t)+"/"))
+	}
+	if len(post.Meta.Description) > 0 {
+		// trailing double space for a line break inside the list item
+		fmt.Fprintf(md, "  \n  %s", markdownEscape(post.Meta.Description))
+	}
+	md.WriteString("\n")
+}
+
+// markdownEscape backslash escapes the characters that could turn plain
+// text into Markdown formatting
+func markdownEscape(s string) string {
+	var out strings.Builder
+	for _, c := range s {
+		if strings.ContainsRune("\\`*_{}[]()<>#+-.!|~$", c) {
+			out.WriteByte('\\')
+		}
+		out.WriteRune(c)
+	}
+	return out.String()
+}
+
+// markdownURL escapes a URL path for use as a Markdown link destination
+// or in an absolute URL, so spaces, parentheses and # in file names don't
+// end the link early
+func markdownURL(p string) string {
+	return (&url.URL{Path: p}).String()
+}
+
+// isBlogPost reports whether urlPath is in the blog directory
+func isBlogPost(urlPath string) bool {
+	if len(*blogDir) == 0 {
+		return false
+	}
+	return path.Dir(urlPath) == "/"+strings.Trim(*blogDir, "/")
+}
@@ -1,37 +1,186 @@
 package main
 
 import (
+	"html/template"
+	"log"
 	"net/http"
+	"os"
+	"sync"
+	"time"
 )
 
 type cacheEntry struct {
 	r Response
 }
 
-func Cache(h http.Handler) http.Handler {
-	c := make(map[string]cacheEntry)
+// ResponseCache holds a handler's successful responses by URL until
+// Invalidate is called
+type ResponseCache struct {
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+}
+
+// resized caches the images served under /resize/
+var resized = &ResponseCache{}
+
+func (c *ResponseCache) Invalidate() {
+	c.mu.Lock()
+	c.entries = nil
+	c.mu.Unlock()
+}
 
+func (c *ResponseCache) Handler(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
-		if r.Method != "GET" {
-			rw.WriteHeader(403)
-			rw.Write([]byte("invalid request type"))
+		if r.Method != "GET" && r.Method != "HEAD" {
+			rw.Header().Set("Allow", "GET, HEAD")
+			serveError(rw, r, 405, "")
 			return
 		}
 
-		entry, exists := c[r.URL.String()]
-		if exists {
-			entry.r.WriteResponse(rw)
-		} else {
+		c.mu.Lock()
+		entry, exists := c.entries[r.URL.String()]
+		c.mu.Unlock()
+		if !exists {
 			rc := ResponseCollector{}
-			// copy request in case they modify it
+			// copy request in case they modify it; HEAD requests fill
+			// the cache too, so always ask for the body
 			req := *r
+			req.Method = "GET"
 			h.ServeHTTP(&rc, &req)
 			resp := rc.CollectResponse()
 			if resp.Code == 200 {
-				c[r.URL.String()] = cacheEntry{resp}
+				c.mu.Lock()
+				if c.entries == nil {
+					c.entries = make(map[string]cacheEntry)
+				}
+				c.entries[r.URL.String()] = cacheEntry{resp}
+				c.mu.Unlock()
 			}
-			resp.WriteResponse(rw)
+			entry = cacheEntry{resp}
+		}
+		if r.Method == "HEAD" {
+			entry.r.WriteHead(rw)
+		} else {
+			entry.r.WriteResponse(rw)
 		}
 		// TODO bookkeeping for the cache here
 	})
 }
+
+// GeneratedCache holds documents generated from the site's content, like
+// feeds and the sitemap, until Invalidate is called
+type GeneratedCache struct {
+	mu   sync.Mutex
+	docs map[string]Response
+}
+
+var generated = &GeneratedCache{}
+
+func (c *GeneratedCache) Invalidate() {
+	c.mu.Lock()
+	c.docs = nil
+	c.mu.Unlock()
+}
+
+// Handler serves the document produced by generate, only calling it again
+// after the cache is invalidated
+func (c *GeneratedCache) Handler(contentType string, generate func() ([]byte, error)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.mu.Lock()
+		resp, ok := c.docs[r.URL.Path]
+		if !ok || DEBUG {
+			body, err := generate()
+			if err != nil {
+				c.mu.Unlock()
+				log.Printf("[ERR] unable to generate %s: %v", r.URL.Path, err)
+				serveError(w, r, 500, "")
+				return
+			}
+			resp = Response{
+				Code:    200,
+				Headers: map[string][]string{"Content-Type": {contentType}},
+				Body:    body,
+			}
+			if c.docs == nil {
+				c.docs = make(map[string]Response)
+			}
+			c.docs[r.URL.Path] = resp
+		}
+		c.mu.Unlock()
+
+		if r.Method == "HEAD" {
+			resp.WriteHead(w)
+		} else {
+			resp.WriteResponse(w)
+		}
+	})
+}
+
+// RenderCache holds the rendered HTML of Markdown pages. Entries are keyed
+// by the files a page was rendered from and are only used while every file
+// still has the same size and modification time; Invalidate throws them
+// all away, for changes that don't touch the files themselves, like a
+// linked page appearing.
+type RenderCache struct {
+	mu      sync.Mutex
+	entries map[string]renderedPage
+}
+
+var renders = &RenderCache{}
+
+type fileStamp struct {
+	size    int64
+	modTime time.Time
+}
+
+type renderedPage struct {
+	stamps  []fileStamp
+	meta    FrontMatter
+	title   string
+	content template.HTML
+}
+
+func (c *RenderCache) Invalidate() {
+	c.mu.Lock()
+	c.entries = nil
+	c.mu.Unlock()
+}
+
+// stampFiles returns the size and modification time of each file
+func stampFiles(paths []string) ([]fileStamp, error) {
+	stamps := make([]fileStamp, 0, len(paths))
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		stamps = append(stamps, fileStamp{info.Size(), info.ModTime()})
+	}
+	return stamps, nil
+}
+
+// Get returns the page rendered from key's files, if they haven't changed
+// since it was rendered
+func (c *RenderCache) Get(key string, stamps []fileStamp) (renderedPage, bool) {
+	c.mu.Lock()
+	page, ok := c.entries[key]
+	c.mu.Unlock()
+	if !ok || DEBUG || len(page.stamps) != len(stamps) {
+		return renderedPage{}, false
+	}
+	for i := range stamps {
+		if page.stamps[i].size != stamps[i].size || !page.stamps[i].modTime.Equal(stamps[i].modTime) {
+			return renderedPage{}, false
+		}
+	}
+	return page, true
+}
+
+func (c *RenderCache) Put(key string, page renderedPage) {
+	c.mu.Lock()
+	if c.entries == nil {
+		c.entries = make(map[string]renderedPage)
+	}
+	c.entries[key] = page
+	c.mu.Unlock()
+}
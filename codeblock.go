@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/shurcooL/sanitized_anchor_name"
+)
+
+// fenceInfo is the parsed info string of a fenced code block, like
+// `c {linenos=true hl_lines=[3,5-7] title="main.c"}`
+type fenceInfo struct {
+	lang        string
+	lineNumbers bool
+	firstLine   int
+	highlight   map[int]bool
+	title       string
+}
+
+// fancy reports whether the block needs more than the plain highlighted output
+func (f fenceInfo) fancy() bool {
+	return f.lineNumbers || len(f.highlight) > 0 || len(f.title) > 0
+}
+
+func parseFenceInfo(info string) fenceInfo {
+	f := fenceInfo{firstLine: 1}
+	info = strings.TrimSpace(info)
+	var attrs string
+	if brace := strings.IndexByte(info, '{'); brace != -1 {
+		attrs = strings.TrimSuffix(strings.TrimSpace(info[brace+1:]), "}")
+		info = info[:brace]
+	} else if fields := strings.Fields(info); len(fields) > 0 && strings.ContainsRune(fields[0], '=') {
+		// blackfriday strips the braces when the info string starts with one
+		attrs, info = info, ""
+	} else if len(fields) > 0 {
+		attrs = strings.TrimSpace(strings.TrimPrefix(info, fields[0]))
+		info = fields[0]
+	}
+	if fields := strings.Fields(info); len(fields) > 0 {
+		f.lang = strings.TrimPrefix(fields[0], ".")
+	}
+
+	for key, value := range parseFenceAttrs(attrs) {
+		switch key {
+		case "linenos":
+			f.lineNumbers = value != "false" && value != "0"
+		case "linenostart":
+			if n, err := strconv.Atoi(value); err == nil {
+				f.firstLine = n
+				f.lineNumbers = true
+			}
+		case "hl_lines":
+			f.highlight = parseLineRanges(value)
+		case "title":
+			f.title = value
+		}
+	}
+	return f
+}
+
+// parseFenceAttrs splits key=value pairs, where values can be "quoted",
+// [bracketed] or bare words; bare keys are treated as true
+func parseFenceAttrs(s string) map[string]string {
+	attrs := make(map[string]string)
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		if len(s) == 0 {
+			return attrs
+		}
+		end := strings.IndexAny(s, "= \t,")
+		if end == -1 {
+			attrs[s] = "true"
+			return attrs
+		}
+		key := s[:end]
+		s = s[end:]
+		if s[0] != '=' {
+			attrs[key] = "true"
+			continue
+		}
+		s = s[1:]
+
+		var value string
+		switch {
+		case strings.HasPrefix(s, `"`), strings.HasPrefix(s, `'`):
+			quote := s[:1]
+			close := strings.Index(s[1:], quote)
+			if close == -1 {
+				value, s = s[1:], ""
+			} else {
+				value, s = s[1:close+1], s[close+2:]
+			}
+		case strings.HasPrefix(s, "["):
+			close := strings.IndexByte(s, ']')
+			if close == -1 {
+				value, s = s[1:], ""
+			} else {
+				value, s = s[1:close], s[close+1:]
+			}
+		default:
+			end := strings.IndexAny(s, " \t,")
+			if end == -1 {
+				end = len(s)
+			}
+			value, s = s[:end], s[end:]
+		}
+		attrs[key] = value
+	}
+}
+
+// parseLineRanges parses line lists like "3,5-7" or "3 5-7"
+func parseLineRanges(s string) map[int]bool {
+	lines := make(map[int]bool)
+	for _, part := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' }) {
+		bounds := strings.SplitN(part, "-", 2)
+		start, err := strconv.Atoi(strings.TrimSpace(bounds[0]))
+		if err != nil {
+			continue
+		}
+		end := start
+		if len(bounds) == 2 {
+			if end, err = strconv.Atoi(strings.TrimSpace(bounds[1])); err != nil {
+				continue
+			}
+		}
+		// don't let a typo like 1-100000000 allocate forever
+		if end-start > 10000 {
+			end = start + 10000
+		}
+		for i := start; i <= end; i++ {
+			lines[i] = true
+		}
+	}
+	return lines
+}
+
+// splitHighlightedLines splits highlighted HTML into lines, closing the
+// spans that are open at the end of each line and reopening them at the
+// start of the next, so every line can be wrapped in its own element.
+// It only understands the <span> tags and escaped text the highlighters emit.
+func splitHighlightedLines(code []byte) [][]byte {
+	var lines [][]byte
+	var open [][]byte
+	var line bytes.Buffer
+	for i := 0; i < len(code); {
+		switch {
+		case code[i] == '\n':
+			for range open {
+				line.WriteString("</span>")
+			}
+			lines = append(lines, append([]byte(nil), line.Bytes()...))
+			line.Reset()
+			for _, tag := range open {
+				line.Write(tag)
+			}
+			i++
+		case bytes.HasPrefix(code[i:], []byte("</span>")):
+			if len(open) > 0 {
+				open = open[:len(open)-1]
+			}
+			line.WriteString("</span>")
+			i += len("</span>")
+		case bytes.HasPrefix(code[i:], []byte("<span")):
+			end := bytes.IndexByte(code[i:], '>')
+			if end == -1 {
+				end = len(code) - i - 1
+			}
+			tag := code[i : i+end+1]
+			open = append(open, tag)
+			line.Write(tag)
+			i += end + 1
+		default:
+			line.WriteByte(code[i])
+			i++
+		}
+	}
+	// the code normally ends in a newline, so there's only something left
+	// over here if it didn't
+	if line.Len() > 0 && !bytes.Equal(line.Bytes(), bytes.Join(open, nil)) {
+		for range open {
+			line.WriteString("</span>")
+		}
+		lines = append(lines, line.Bytes())
+	}
+	return lines
+}
+
+// codeBlockID returns a unique id for a code block with the given title.
+// Heading anchors never contain a colon, so the "code:" prefix keeps code
+// blocks from changing them: untitled blocks are code:1, code:2 and so on,
+// and titled ones code: and the title's anchor name.
+func (r *renderer) codeBlockID(title string) string {
+	if len(title) > 0 {
+		return r.uniqueAnchor("code:" + sanitized_anchor_name.Create(title))
+	}
+	n := 1
+	for r.anchors["code:"+strconv.Itoa(n)] {
+		n++
+	}
+	id := "code:" + strconv.Itoa(n)
+	r.anchors[id] = true
+	return id
+}
+
+// writeFancyCode writes a code block with a caption, line anchors, line
+// numbers and highlighted lines as requested by f. code is already
+// highlighted or escaped HTML.
+func (r *renderer) writeFancyCode(out *bytes.Buffer, code []byte, f fenceInfo) {
+	id := r.codeBlockID(f.title)
+
+	out.WriteString(`<figure class="code-block" id="`)
+	attrEscape(out, []byte(id))
+	out.WriteString(`">`)
+	if len(f.title) > 0 {
+		out.WriteString(`<figcaption class="code-title">`)
+		attrEscape(out, []byte(f.title))
+		out.WriteString("</figcaption>")
+	}
+	if len(f.lang) > 0 {
+		out.WriteString(`<div class="highlight highlight-`)
+		attrEscape(out, []byte(f.lang))
+		out.WriteString(`"><pre>`)
+	} else {
+		out.WriteString("<pre><code>")
+	}
+	for i, line := range splitHighlightedLines(code) {
+		n := f.firstLine + i
+		lineID := fmt.Sprintf("%s-L%d", id, n)
+		out.WriteString(`<span class="line`)
+		if f.highlight[n] {
+			out.WriteString(" line-highlight")
+		}
+		out.WriteString(`" id="`)
+		attrEscape(out, []byte(lineID))
+		out.WriteString(`">`)
+		if f.lineNumbers {
+			out.WriteString(`<a class="line-number" href="#`)
+			attrEscape(out, []byte(lineID))
+			fmt.Fprintf(out, `" aria-hidden="true">%d</a>`, n)
+		}
+		out.Write(line)
+		out.WriteString("\n</span>")
+	}
+	if len(f.lang) > 0 {
+		out.WriteString("</pre></div>")
+	} else {
+		out.WriteString("</code></pre>")
+	}
+	out.WriteString("</figure>\n")
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"net/http"
+	"strconv"
 )
 
 type Response struct {
@@ -11,13 +12,24 @@ type Response struct {
 }
 
 func (r Response) WriteResponse(rw http.ResponseWriter) {
+	r.writeHeaders(rw)
+	rw.WriteHeader(r.Code)
+	rw.Write(r.Body)
+}
+
+// WriteHead writes everything but the body, for answering HEAD requests
+func (r Response) WriteHead(rw http.ResponseWriter) {
+	r.writeHeaders(rw)
+	rw.Header().Set("Content-Length", strconv.Itoa(len(r.Body)))
+	rw.WriteHeader(r.Code)
+}
+
+func (r Response) writeHeaders(rw http.ResponseWriter) {
 	for k, vs := range r.Headers {
 		for _, v := range vs {
 			rw.Header().Add(k, v)
 		}
 	}
-	rw.WriteHeader(r.Code)
-	rw.Write(r.Body)
 }
 
 // implements ResponseWriter to collect HTTP responses
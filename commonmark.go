@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/shurcooL/sanitized_anchor_name"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/parser"
+	goldmarkrenderer "github.com/yuin/goldmark/renderer"
+	"github.com/yuin/goldmark/renderer/html"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+)
+
+// The CommonMark backend parses with goldmark, which follows the CommonMark
+// and GFM specs, and renders headings, links, images and code blocks through the
+// same renderer methods as the blackfriday backend so pages look the same.
+
+// commonMark is the goldmark instance every page is rendered with; the
+// per page renderer is passed to it in the document's metadata
+var commonMark = goldmark.New(
+	goldmark.WithExtensions(
+		extension.GFM,
+		extension.DefinitionList,
+		extension.NewFootnote(extension.WithFootnoteIDPrefixFunction(func(n ast.Node) []byte {
+			return []byte(pageRenderer(n).footnotePrefix)
+		})),
+	),
+	goldmark.WithParserOptions(
+		parser.WithASTTransformers(
+			util.Prioritized(alertTransformer{}, 100),
+			util.Prioritized(hardBreakTransformer{}, 100),
+		),
+	),
+	goldmark.WithRendererOptions(
+		// pages are ours, and the ones that aren't get sanitized afterwards
+		html.WithUnsafe(),
+		html.WithXHTML(),
+		goldmarkrenderer.WithNodeRenderers(util.Prioritized(commonMarkRenderer{}, 100)),
+	),
+)
+
+// rendererMeta is the document metadata key holding the page's *renderer
+const rendererMeta = "kelvinly-server/renderer"
+
+// pageRenderer returns the renderer for the page n is part of
+func pageRenderer(n ast.Node) *renderer {
+	return n.OwnerDocument().Meta()[rendererMeta].(*renderer)
+}
+
+// renderCommonMark renders text with goldmark, collecting headings and
+// anchors in r
+func renderCommonMark(source []byte, r *renderer) []byte {
+	doc := commonMark.Parser().Parse(text.NewReader(source))
+	doc.OwnerDocument().AddMeta(rendererMeta, r)
+	var out bytes.Buffer
+	if err := commonMark.Renderer().Render(&out, source, doc); err != nil {
+		// goldmark only fails when writing fails, which a bytes.Buffer doesn't
+		return []byte(fmt.Sprintf("<p>unable to render Markdown: %s</p>", err))
+	}
+	return out.Bytes()
+}
+
+// commonMarkRenderer overrides goldmark's HTML for the nodes we customize,
+// handing them to the page's renderer
+type commonMarkRenderer struct{}
+
+func (c commonMarkRenderer) RegisterFuncs(reg goldmarkrenderer.NodeRendererFuncRegisterer) {
+	reg.Register(ast.KindHeading, c.renderHeading)
+	reg.Register(ast.KindImage, c.renderImage)
+	reg.Register(ast.KindLink, c.renderLink)
+	reg.Register(ast.KindAutoLink, c.renderAutoLink)
+	reg.Register(ast.KindFencedCodeBlock, c.renderCodeBlock)
+	reg.Register(ast.KindCodeBlock, c.renderCodeBlock)
+	reg.Register(kindAlert, c.renderAlert)
+}
+
+// nodeText returns the plain text inside a node
+func nodeText(n ast.Node, source []byte) string {
+	var b strings.Builder
+	ast.Walk(n, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+		switch n := n.(type) {
+		case *ast.Text:
+			b.Write(util.UnescapePunctuations(n.Segment.Value(source)))
+			if n.SoftLineBreak() || n.HardLineBreak() {
+				b.WriteByte(' ')
+			}
+		case *ast.String:
+			b.Write(n.Value)
+		case *ast.RawHTML:
+			return ast.WalkSkipChildren, nil
+		}
+		return ast.WalkContinue, nil
+	})
+	return string(util.ResolveEntityNames(util.ResolveNumericReferences([]byte(b.String()))))
+}
+
+func (c commonMarkRenderer) renderHeading(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	n := node.(*ast.Heading)
+	if !entering {
+		fmt.Fprintf(w, "</h%d>\n", n.Level)
+		return ast.WalkContinue, nil
+	}
+	r := pageRenderer(n)
+	textContent := nodeText(n, source)
+	// math is still a placeholder here, and shouldn't end up in the anchor
+	anchorName := r.uniqueAnchor(sanitized_anchor_name.Create(mathPlaceholder.ReplaceAllString(textContent, "")))
+	r.headings = append(r.headings, heading{n.Level, anchorName, textContent})
+	fmt.Fprintf(w, `<h%d><a name="%s" class="anchor" href="#%s" rel="nofollow" aria-hidden="true"><span class="octicon octicon-link"></span></a>`, n.Level, anchorName, anchorName)
+	return ast.WalkContinue, nil
+}
+
+func (c commonMarkRenderer) renderImage(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if !entering {
+		return ast.WalkContinue, nil
+	}
+	n := node.(*ast.Image)
+	var out bytes.Buffer
+	pageRenderer(n).Image(&out, n.Destination, n.Title, []byte(nodeText(n, source)))
+	w.Write(out.Bytes())
+	return ast.WalkSkipChildren, nil
+}
+
+func (c commonMarkRenderer) renderLink(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if !entering {
+		w.WriteString("</a>")
+		return ast.WalkContinue, nil
+	}
+	n := node.(*ast.Link)
+	var out bytes.Buffer
+	title := util.ResolveEntityNames(util.ResolveNumericReferences(util.UnescapePunctuations(n.Title)))
+	pageRenderer(n).linkOpen(&out, util.URLEscape(n.Destination, true), title)
+	w.Write(out.Bytes())
+	return ast.WalkContinue, nil
+}
+
+func (c commonMarkRenderer) renderAutoLink(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if !entering {
+		return ast.WalkContinue, nil
+	}
+	n := node.(*ast.AutoLink)
+	link := n.URL(source)
+	if n.AutoLinkType == ast.AutoLinkEmail && !bytes.HasPrefix(bytes.ToLower(link), []byte("mailto:")) {
+		link = append([]byte("mailto:"), link...)
+	}
+	var out bytes.Buffer
+	pageRenderer(n).linkOpen(&out, util.URLEscape(link, false), nil)
+	out.Write(util.EscapeHTML(n.Label(source)))
+	out.WriteString("</a>")
+	w.Write(out.Bytes())
+	return ast.WalkSkipChildren, nil
+}
+
+func (c commonMarkRenderer) renderCodeBlock(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if !entering {
+		return ast.WalkContinue, nil
+	}
+	var info string
+	if n, ok := node.(*ast.FencedCodeBlock); ok && n.Info != nil {
+		// backslash escapes and entities work in info strings too
+		info = string(util.ResolveEntityNames(util.ResolveNumericReferences(util.UnescapePunctuations(n.Info.Segment.Value(source)))))
+	}
+	var code bytes.Buffer
+	lines := node.Lines()
+	for i := 0; i < lines.Len(); i++ {
+		line := lines.At(i)
+		code.Write(line.Value(source))
+	}
+	var out bytes.Buffer
+	pageRenderer(node).BlockCode(&out, code.Bytes(), info)
+	w.Write(out.Bytes())
+	return ast.WalkSkipChildren, nil
+}
+
+func (c commonMarkRenderer) renderAlert(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	n := node.(*alertNode)
+	if !entering {
+		w.WriteString("</div>\n")
+		return ast.WalkContinue, nil
+	}
+	fmt.Fprintf(w, `<div class="markdown-alert markdown-alert-%s">`+"\n", n.alert)
+	fmt.Fprintf(w, `<p class="markdown-alert-title">%s</p>`+"\n", strings.ToUpper(n.alert[:1])+n.alert[1:])
+	return ast.WalkContinue, nil
+}
+
+// alertNode is a blockquote that started with [!NOTE] or the like
+type alertNode struct {
+	ast.BaseBlock
+	alert string
+}
+
+var kindAlert = ast.NewNodeKind("Alert")
+
+func (n *alertNode) Kind() ast.NodeKind {
+	return kindAlert
+}
+
+func (n *alertNode) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, map[string]string{"Alert": n.alert}, nil)
+}
+
+var alertLine = regexp.MustCompile(`(?i)^\[!(note|tip|important|warning|caution)\]\s*$`)
+
+// alertTransformer turns blockquotes whose first line is an alert marker
+// into alertNodes
+type alertTransformer struct{}
+
+func (alertTransformer) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	source := reader.Source()
+	var quotes []*ast.Blockquote
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if q, ok := n.(*ast.Blockquote); ok && entering {
+			quotes = append(quotes, q)
+		}
+		return ast.WalkContinue, nil
+	})
+
+	for _, q := range quotes {
+		para, ok := q.FirstChild().(*ast.Paragraph)
+		if !ok {
+			continue
+		}
+		// the marker is split into several text nodes by the link parser,
+		// so gather the first line
+		var first strings.Builder
+		var marker []ast.Node
+		for c := para.FirstChild(); c != nil; c = c.NextSibling() {
+			t, ok := c.(*ast.Text)
+			if !ok {
+				break
+			}
+			first.Write(t.Segment.Value(source))
+			marker = append(marker, c)
+			if t.SoftLineBreak() || t.HardLineBreak() {
+				break
+			}
+		}
+		m := alertLine.FindStringSubmatch(first.String())
+		if m == nil {
+			continue
+		}
+
+		for _, c := range marker {
+			para.RemoveChild(para, c)
+		}
+		if para.ChildCount() == 0 {
+			q.RemoveChild(q, para)
+		}
+		alert := &alertNode{alert: strings.ToLower(m[1])}
+		for c := q.FirstChild(); c != nil; {
+			next := c.NextSibling()
+			alert.AppendChild(alert, c)
+			c = next
+		}
+		q.Parent().ReplaceChild(q.Parent(), q, alert)
+	}
+}
+
+// hardBreakTransformer drops the spaces before a hard line break. The
+// linkify extension splits text at spaces, which leaves them in a text
+// node of their own where goldmark doesn't trim them.
+type hardBreakTransformer struct{}
+
+func (hardBreakTransformer) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	source := reader.Source()
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		t, ok := n.(*ast.Text)
+		if !ok || !entering || !t.HardLineBreak() {
+			return ast.WalkContinue, nil
+		}
+		for t != nil {
+			t.Segment = t.Segment.TrimRightSpace(source)
+			if !t.Segment.IsEmpty() {
+				break
+			}
+			t, _ = t.PreviousSibling().(*ast.Text)
+		}
+		return ast.WalkContinue, nil
+	})
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/russross/blackfriday"
+)
+
+// specFailures are the spec examples renderCommonMark renders differently
+// on purpose, after normalizeSpecHTML, and why
+var specFailures = map[string]map[int]string{
+	"testdata/spec.json": {
+		// BlockCode highlights code with a language, like GitHub does
+		24:  "fenced code with an info string is highlighted",
+		34:  "fenced code with an info string is highlighted",
+		142: "fenced code with an info string is highlighted",
+		143: "fenced code with an info string is highlighted",
+		144: "fenced code with an info string is highlighted",
+		146: "fenced code with an info string is highlighted",
+		// the extension examples 621-631 in gfm.json cover these
+		608: "GFM autolinks bare URLs and email addresses",
+		611: "GFM autolinks bare URLs and email addresses",
+		612: "GFM autolinks bare URLs and email addresses",
+	},
+	"testdata/gfm.json": {
+		// pages are ours and trusted, untrusted directories go through
+		// -sanitize-dirs instead
+		653: "raw HTML isn't tag filtered",
+	},
+}
+
+// specExample is an example from testdata/spec.json, goldmark's copy of the
+// CommonMark spec examples, or testdata/gfm.json, the examples from the
+// extension sections of the GFM spec
+type specExample struct {
+	Markdown string
+	HTML     string
+	Section  string
+	Example  int
+}
+
+var (
+	// headingAnchor is the link renderHeading puts in every heading
+	headingAnchor = regexp.MustCompile(`<a name="[^"]*" class="anchor" href="#[^"]*" rel="nofollow" aria-hidden="true"><span class="octicon octicon-link"></span></a>`)
+	// responsiveImage is an image as renderer.Image writes it for a
+	// document at the root of static/
+	responsiveImage = regexp.MustCompile(`<picture><source srcset="([^"]*)" media="\(min-width: 800px\)"><img src="/resize//[^"]*"([^>]*)></picture>`)
+	specLink        = regexp.MustCompile(`<a href="([^"]*)"`)
+	voidElement     = regexp.MustCompile(`<(input|img|br|hr)([^>]*?) ?/?>`)
+)
+
+// normalizeSpecHTML undoes the changes renderCommonMark makes to every
+// document, so the rest of its output can be compared with the spec
+func normalizeSpecHTML(e specExample, got string) (string, string) {
+	want := e.HTML
+	got = headingAnchor.ReplaceAllString(got, "")
+	got = strings.Replace(got, ` class="broken-link"`, "", -1)
+	got = responsiveImage.ReplaceAllString(got, `<img src="$1"$2>`)
+	// relative links are resolved against the document's directory,
+	// unless they're in raw HTML
+	if !strings.Contains(e.Markdown, "<a ") {
+		want = specLink.ReplaceAllStringFunc(want, func(a string) string {
+			href, _ := resolveLink("", specLink.FindStringSubmatch(a)[1])
+			return `<a href="` + href + `"`
+		})
+	}
+	// the GFM spec writes <input> and the CommonMark one <br />
+	got = voidElement.ReplaceAllString(got, "<$1$2>")
+	want = voidElement.ReplaceAllString(want, "<$1$2>")
+	return got, want
+}
+
+func readSpecExamples(t *testing.T, file string) []specExample {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var examples []specExample
+	if err := json.Unmarshal(b, &examples); err != nil {
+		t.Fatalf("%s: %v", file, err)
+	}
+	return examples
+}
+
+func TestCommonMarkSpec(t *testing.T) {
+	defer func(class, rel, target, outbound string) {
+		*externalClass, *externalRel, *externalTarget, *outboundPath = class, rel, target, outbound
+	}(*externalClass, *externalRel, *externalTarget, *outboundPath)
+	*externalClass, *externalRel, *externalTarget, *outboundPath = "", "", "", ""
+
+	for file, failures := range specFailures {
+		for _, e := range readSpecExamples(t, file) {
+			r := &renderer{
+				Html:    blackfriday.HtmlRenderer(0, "", "").(*blackfriday.Html),
+				anchors: make(map[string]bool),
+			}
+			got, want := normalizeSpecHTML(e, string(renderCommonMark([]byte(e.Markdown), r)))
+
+			reason, known := failures[e.Example]
+			switch {
+			case got != want && !known:
+				t.Errorf("%s example %d (%s):\n%q\nrendered as\n%q\nwant\n%q", file, e.Example, e.Section, e.Markdown, got, want)
+			case got == want && known:
+				t.Errorf("%s example %d (%s) passes now, remove it from specFailures (%s)", file, e.Example, e.Section, reason)
+			}
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+var devMode = flag.Bool("dev", false, "watch static/, main.css and the templates while writing locally, throwing away cached pages and reloading open tabs when they change")
+
+const (
+	DEV_RELOAD_PATH = "/dev-reload"
+	// editors often write a file in several steps, so wait for them to settle
+	WATCH_DEBOUNCE = 100 * time.Millisecond
+	// comment lines keep proxies from closing idle event streams
+	RELOAD_KEEPALIVE = 30 * time.Second
+)
+
+// reloadScript is added to every page in dev mode. It reloads the page when
+// told to, and when the connection comes back after the server restarts.
+const reloadScript = `(function() {
+	var events = new EventSource("` + DEV_RELOAD_PATH + `"), lost = false;
+	events.addEventListener("reload", function() { location.reload(); });
+	events.onerror = function() { lost = true; };
+	events.onopen = function() { if (lost) location.reload(); };
+})();`
+
+// injectReloadScript puts the reload script at the end of the page's body
+func injectReloadScript(page []byte, nonce string) []byte {
+	script := fmt.Sprintf("<script nonce=\"%s\">\n%s\n</script>\n", nonce, reloadScript)
+	at := bytes.LastIndex(page, []byte("</body>"))
+	if at == -1 {
+		return append(page, script...)
+	}
+	out := make([]byte, 0, len(page)+len(script))
+	out = append(out, page[:at]...)
+	out = append(out, script...)
+	return append(out, page[at:]...)
+}
+
+// ReloadHub tells the pages open in browsers to reload
+type ReloadHub struct {
+	mu      sync.Mutex
+	clients map[chan struct{}]bool
+	closed  chan struct{}
+	once    sync.Once
+}
+
+var reloads = &ReloadHub{closed: make(chan struct{})}
+
+func (h *ReloadHub) subscribe() chan struct{} {
+	ch := make(chan struct{}, 1)
+	h.mu.Lock()
+	if h.clients == nil {
+		h.clients = make(map[chan struct{}]bool)
+	}
+	h.clients[ch] = true
+	h.mu.Unlock()
+	return ch
+}
+
+func (h *ReloadHub) unsubscribe(ch chan struct{}) {
+	h.mu.Lock()
+	delete(h.clients, ch)
+	h.mu.Unlock()
+}
+
+// Broadcast asks every open page to reload
+func (h *ReloadHub) Broadcast() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.clients {
+		// a reload is already pending if the channel is full
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Close ends every event stream, since server shutdown waits for them
+func (h *ReloadHub) Close() {
+	h.once.Do(func() { close(h.closed) })
+}
+
+// ReloadHandler streams reload events to a page as server-sent events
+func ReloadHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		serveError(w, r, 500, "streaming isn't supported")
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(200)
+	fmt.Fprint(w, "retry: 1000\n\n")
+	flusher.Flush()
+
+	ch := reloads.subscribe()
+	defer reloads.unsubscribe(ch)
+	keepalive := time.NewTicker(RELOAD_KEEPALIVE)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-ch:
+			fmt.Fprint(w, "event: reload\ndata: \n\n")
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case <-r.Context().Done():
+			return
+		case <-reloads.closed:
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// WatchSite watches static/, main.css and the templates, and once changes
+// settle throws away everything rendered from them and reloads open pages
+func WatchSite() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := watchTree(watcher, STATIC_DIR); err != nil {
+		watcher.Close()
+		return err
+	}
+	if err := watchTree(watcher, *templateDir); err != nil {
+		watcher.Close()
+		return err
+	}
+	// editors often replace files instead of writing them, which loses a
+	// watch on the file itself, so watch the directory holding it
+	if err := watcher.Add("."); err != nil {
+		watcher.Close()
+		return err
+	}
+
+	go func() {
+		defer watcher.Close()
+		var settled <-chan time.Time
+		var content, templates, css bool
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				name := filepath.Clean(event.Name)
+				switch {
+				case inDir(name, STATIC_DIR):
+					if isHidden(staticURLPath(name)) {
+						continue
+					}
+					if event.Op&fsnotify.Create != 0 {
+						if info, err := os.Stat(name); err == nil && info.IsDir() {
+							if err := watchTree(watcher, name); err != nil {
+								log.Printf("[ERR] unable to watch %s: %v", name, err)
+							}
+						}
+					}
+					content = true
+				case inDir(name, *templateDir):
+					templates = true
+				case name == "main.css":
+					css = true
+				default:
+					continue
+				}
+				settled = time.After(WATCH_DEBOUNCE)
+			case <-settled:
+				var changed []string
+				if content {
+					contentUpdated()
+					changed = append(changed, STATIC_DIR)
+				}
+				if templates {
+					if err := LoadLayouts(); err != nil {
+						log.Printf("[ERR] unable to reload layouts: %v", err)
+					}
+					changed = append(changed, *templateDir)
+				}
+				if css {
+					changed = append(changed, "main.css")
+				}
+				log.Printf("%s changed, reloading pages", strings.Join(changed, ", "))
+				reloads.Broadcast()
+				content, templates, css = false, false, false
+				settled = nil
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("[ERR] file watcher: %v", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// watchTree watches dir and every directory below it, skipping hidden
+// directories under static/ like .git
+func watchTree(watcher *fsnotify.Watcher, dir string) error {
+	return filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if inDir(file, STATIC_DIR) && isHidden(staticURLPath(file)) {
+			return filepath.SkipDir
+		}
+		return watcher.Add(file)
+	})
+}
+
+// inDir reports whether file is dir or somewhere below it
+func inDir(file, dir string) bool {
+	dir = filepath.Clean(dir)
+	return file == dir || strings.HasPrefix(file, dir+string(filepath.Separator))
+}
+
+// staticURLPath returns the URL path of a file under static/
+func staticURLPath(file string) string {
+	rel, err := filepath.Rel(STATIC_DIR, file)
+	if err != nil || rel == "." {
+		return "/"
+	}
+	return "/" + filepath.ToSlash(rel)
+}
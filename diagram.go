@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"html"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+var graphvizCommand = flag.String("graphviz", "", "graphviz command used for dot fences, e.g. \"dot -Tsvg\"; empty uses the built in layout")
+
+const (
+	MAX_DIAGRAM_CACHE = 500
+	DIAGRAM_TIMEOUT   = 10 * time.Second
+)
+
+// DiagramRenderer turns the source of a diagram fence into an SVG element
+type DiagramRenderer interface {
+	RenderSVG(src []byte) ([]byte, error)
+}
+
+// DiagramRendererFunc lets ordinary functions be DiagramRenderers
+type DiagramRendererFunc func(src []byte) ([]byte, error)
+
+func (f DiagramRendererFunc) RenderSVG(src []byte) ([]byte, error) {
+	return f(src)
+}
+
+// diagramRenderers maps fence languages onto the renderers for them
+var diagramRenderers = map[string]DiagramRenderer{
+	"dot":       DiagramRendererFunc(renderDot),
+	"graphviz":  DiagramRendererFunc(renderDot),
+	"mermaid":   DiagramRendererFunc(renderFlowchart),
+	"flowchart": DiagramRendererFunc(renderFlowchart),
+}
+
+// diagramRendererFor returns the renderer for a fence language, if it's a diagram
+func diagramRendererFor(lang string) (DiagramRenderer, bool) {
+	lang = strings.ToLower(lang)
+	if (lang == "dot" || lang == "graphviz") && len(*graphvizCommand) > 0 {
+		return commandRenderer(strings.Fields(*graphvizCommand)), true
+	}
+	r, ok := diagramRenderers[lang]
+	return r, ok
+}
+
+// commandRenderer renders diagrams with an external program that reads the
+// source on stdin and writes SVG to stdout
+type commandRenderer []string
+
+func (c commandRenderer) RenderSVG(src []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), DIAGRAM_TIMEOUT)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, c[0], c[1:]...)
+	cmd.Stdin = bytes.NewReader(src)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); len(msg) > 0 {
+			return nil, errors.New(msg)
+		}
+		return nil, err
+	}
+	// drop the XML declaration and doctype, which don't belong inline
+	svg := stdout.Bytes()
+	start := bytes.Index(svg, []byte("<svg"))
+	if start == -1 {
+		return nil, fmt.Errorf("%s didn't output SVG", c[0])
+	}
+	return svg[start:], nil
+}
+
+// DiagramCache keeps rendered diagrams by a hash of their source, since
+// laying them out is too slow to redo on every page view. Failures aren't
+// kept, so a graphviz run that timed out is tried again next time.
+type DiagramCache struct {
+	mu      sync.Mutex
+	entries map[string][]byte
+	// keys from oldest to newest, for evicting the oldest when it's full
+	order []string
+}
+
+var diagrams = &DiagramCache{}
+
+func (c *DiagramCache) Render(lang string, r DiagramRenderer, src []byte) ([]byte, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00", lang, *graphvizCommand)
+	h.Write(src)
+	key := hex.EncodeToString(h.Sum(nil))
+
+	c.mu.Lock()
+	svg, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok {
+		return svg, nil
+	}
+
+	svg, err := r.RenderSVG(src)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	if c.entries == nil {
+		c.entries = make(map[string][]byte)
+	}
+	if _, ok := c.entries[key]; !ok {
+		for len(c.order) >= MAX_DIAGRAM_CACHE {
+			delete(c.entries, c.order[0])
+			c.order = c.order[1:]
+		}
+		c.order = append(c.order, key)
+	}
+	c.entries[key] = svg
+	c.mu.Unlock()
+	return svg, nil
+}
+
+// writeDiagram writes a rendered diagram, or an error block showing the
+// source if it couldn't be rendered
+func writeDiagram(out *bytes.Buffer, r DiagramRenderer, src []byte, f fenceInfo) {
+	svg, err := diagrams.Render(f.lang, r, src)
+	if err != nil {
+		out.WriteString(`<div class="diagram-error"><p><strong>Unable to render `)
+		out.WriteString(html.EscapeString(f.lang))
+		out.WriteString(" diagram:</strong> ")
+		out.WriteString(html.EscapeString(err.Error()))
+		out.WriteString("</p><pre><code>")
+		attrEscape(out, src)
+		out.WriteString("</code></pre></div>\n")
+		return
+	}
+
+	out.WriteString(`<figure class="diagram diagram-`)
+	attrEscape(out, []byte(strings.ToLower(f.lang)))
+	out.WriteString(`">`)
+	out.Write(svg)
+	if len(f.title) > 0 {
+		out.WriteString(`<figcaption class="diagram-title">`)
+		attrEscape(out, []byte(f.title))
+		out.WriteString("</figcaption>")
+	}
+	out.WriteString("</figure>\n")
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"html"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// default explanations for error pages; sites can replace the whole page
+// by adding a Markdown file named after the status code, like static/404.md
+var errorMessages = map[int]string{
+	400: "The request didn't make sense to the server.",
+	403: "You don't have permission to see this page.",
+	404: "There's nothing here; try the home page instead.",
+	405: "This page doesn't support that kind of request.",
+	500: "Something went wrong while building this page.",
+	502: "The server behind this page isn't responding properly.",
+	503: "This page is temporarily unavailable; try again in a bit.",
+}
+
+// serveError writes an error response for code. Clients that ask for JSON get
+// a JSON object, everyone else gets an HTML page rendered with the site's
+// layout. detail is shown in addition to the default message, and may be
+// empty.
+func serveError(w http.ResponseWriter, r *http.Request, code int, detail string) {
+	// don't let a half written response get cached as a success
+	w.Header().Del("Content-Length")
+	w.Header().Del("Last-Modified")
+	w.Header().Del("ETag")
+
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(code)
+		resp := struct {
+			Status  int    `json:"status"`
+			Error   string `json:"error"`
+			Message string `json:"message"`
+			Detail  string `json:"detail,omitempty"`
+		}{code, http.StatusText(code), errorMessages[code], detail}
+		json.NewEncoder(w).Encode(&resp)
+		return
+	}
+
+	custom := STATIC_DIR + "/" + strconv.Itoa(code) + ".md"
+	if b, err := ioutil.ReadFile(custom); err == nil {
+		if meta, body, err := ParseFrontMatter(b); err == nil {
+			title := meta.Title
+			if len(title) == 0 {
+				title = markdownTitle(body)
+			}
+			renderPage(w, r, code, Page{
+				Title:   title,
+				Meta:    meta,
+				Content: template.HTML(Markdown(body, "")),
+				Layout:  meta.Layout,
+			})
+			return
+		} else {
+			log.Printf("[ERR] unable to use %s: %v", custom, err)
+		}
+	}
+
+	title := strconv.Itoa(code) + " " + http.StatusText(code)
+	content := "<h1>" + html.EscapeString(title) + "</h1>\n"
+	if msg, ok := errorMessages[code]; ok {
+		content += "<p>" + html.EscapeString(msg) + "</p>\n"
+	}
+	if len(detail) > 0 {
+		content += "<p><code>" + html.EscapeString(detail) + "</code></p>\n"
+	}
+	renderPage(w, r, code, Page{Title: title, Content: template.HTML(content)})
+}
+
+// wantsJSON reports whether the client would rather have JSON than HTML
+func wantsJSON(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "application/json") && !strings.Contains(accept, "text/html")
+}
+
+// proxyErrorHandler is used by the reverse proxies when the backend is down
+func proxyErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	log.Printf("[ERR] proxying %s%s failed: %v", r.Host, r.URL.Path, err)
+	serveError(w, r, 502, "")
+}
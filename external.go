@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"html"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+var (
+	externalRel    = flag.String("external-rel", "noopener noreferrer nofollow", "rel attribute added to links that leave the site; empty adds none")
+	externalTarget = flag.String("external-target", "", "target attribute added to links that leave the site, e.g. _blank")
+	externalClass  = flag.String("external-class", "external-link", "class added to links that leave the site, which main.css gives an icon; empty adds none")
+	outboundPath   = flag.String("outbound-path", "", "path of an endpoint that counts clicks on links leaving the site before redirecting, e.g. /out; empty links directly")
+)
+
+// isExternalLink reports whether link is an http(s) link to somewhere
+// other than this site or its subdomains
+func isExternalLink(link string) bool {
+	u, err := url.Parse(strings.TrimSpace(link))
+	if err != nil || len(u.Host) == 0 {
+		return false
+	}
+	if u.Scheme != "" && u.Scheme != "http" && u.Scheme != "https" {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	return host != DOMAIN_NAME && !strings.HasSuffix(host, "."+DOMAIN_NAME)
+}
+
+// outbound links are signed so the endpoint can't be used as an open
+// redirect; the key only lives as long as the process, and links signed
+// by an earlier run get a page asking before leaving instead
+var outboundKey = func() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		log.Fatalf("unable to generate outbound link key: %v", err)
+	}
+	return key
+}()
+
+func outboundSignature(target string) string {
+	mac := hmac.New(sha256.New, outboundKey)
+	mac.Write([]byte(target))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// outboundURL returns the link through the -outbound-path endpoint
+func outboundURL(target string) string {
+	v := url.Values{}
+	v.Set("to", target)
+	v.Set("sig", outboundSignature(target))
+	return *outboundPath + "?" + v.Encode()
+}
+
+// OutboundClicks counts clicks on each outbound link since the server started
+type OutboundClicks struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+var outboundClicks = &OutboundClicks{}
+
+func (c *OutboundClicks) Add(target string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.counts == nil {
+		c.counts = make(map[string]int)
+	}
+	c.counts[target]++
+	return c.counts[target]
+}
+
+// OutboundHandler counts a click on an outbound link and redirects to it
+func OutboundHandler(w http.ResponseWriter, r *http.Request) {
+	target := r.URL.Query().Get("to")
+	if !isExternalLink(target) {
+		serveError(w, r, 400, "not an outbound link")
+		return
+	}
+	// every click should reach us to be counted
+	w.Header().Set("Cache-Control", "no-store")
+
+	if !hmac.Equal([]byte(r.URL.Query().Get("sig")), []byte(outboundSignature(target))) {
+		escaped := html.EscapeString(target)
+		renderPage(w, r, 200, Page{
+			Title: "Leaving the site",
+			Content: template.HTML("<h1>Leaving the site</h1>\n<p>This link goes to <a href=\"" + escaped + "\" rel=\"noopener noreferrer nofollow\">" +
+				escaped + "</a>, which isn't part of this site.</p>\n"),
+		})
+		return
+	}
+
+	n := outboundClicks.Add(target)
+	log.Printf("outbound click %d on %s", n, target)
+	http.Redirect(w, r, target, http.StatusFound)
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"flag"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+var (
+	feedTitle  = flag.String("feed-title", DOMAIN_NAME, "title of the Atom, RSS and JSON feeds")
+	feedAuthor = flag.String("feed-author", "Kelvin Ly", "author named in the feeds")
+	feedSize   = flag.Int("feed-size", 20, "number of posts included in the feeds")
+)
+
+// feedPosts returns the posts that go in the feeds
+func feedPosts() []*Post {
+	posts := blog.Posts()
+	if len(posts) > *feedSize {
+		posts = posts[:*feedSize]
+	}
+	return posts
+}
+
+// siteURL returns the absolute URL for a path on this site
+func siteURL(p string) string {
+	return "https://" + DOMAIN_NAME + p
+}
+
+// pageURL returns the absolute URL for the page at the unescaped path p
+func pageURL(p string) string {
+	return siteURL(markdownURL(p))
+}
+
+// feedUpdated returns the newest update time of the posts
+func feedUpdated(posts []*Post) time.Time {
+	var updated time.Time
+	for _, post := range posts {
+		if post.Updated.After(updated) {
+			updated = post.Updated
+		}
+	}
+	if updated.IsZero() {
+		updated = time.Now()
+	}
+	return updated
+}
+
+// postContent renders a post to HTML with every link made absolute, since
+// feed readers don't know what the links are relative to
+func postContent(post *Post) (string, error) {
+	b, err := ioutil.ReadFile(post.File)
+	if err != nil {
+		return "", err
+	}
+	_, body, err := ParseFrontMatter(b)
+	if err != nil {
+		return "", err
+	}
+	dir := path.Dir(post.Path)
+	rendered := Markdown(body, strings.TrimPrefix(dir, "/"))
+	// resolve against the post itself so links within it stay on the post
+	base, err := url.Parse(pageURL(post.Path))
+	if err != nil {
+		return "", err
+	}
+	return absolutizeLinks(rendered, base), nil
+}
+
+// absolutizeLinks resolves the href, src and srcset attributes in an HTML
+// fragment against base
+func absolutizeLinks(fragment []byte, base *url.URL) string {
+	resolve := func(ref string) string {
+		u, err := url.Parse(strings.TrimSpace(ref))
+		if err != nil {
+			return ref
+		}
+		return base.ResolveReference(u).String()
+	}
+
+	var out bytes.Buffer
+	z := html.NewTokenizer(bytes.NewReader(fragment))
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+		tok := z.Token()
+		if tt == html.StartTagToken || tt == html.SelfClosingTagToken {
+			for i, attr := range tok.Attr {
+				switch attr.Key {
+				case "href", "src":
+					tok.Attr[i].Val = resolve(attr.Val)
+				case "srcset":
+					candidates := strings.Split(attr.Val, ",")
+					for j, c := range candidates {
+						fields := strings.Fields(c)
+						if len(fields) > 0 {
+							fields[0] = resolve(fields[0])
+						}
+						candidates[j] = strings.Join(fields, " ")
+					}
+					tok.Attr[i].Val = strings.Join(candidates, ", ")
+				}
+			}
+		}
+		out.WriteString(tok.String())
+	}
+	return out.String()
+}
+
+// lastModified returns when a file under static/ was last committed,
+// falling back to its modification time if git doesn't know about it
+func lastModified(file string) time.Time {
+	cmd := exec.Command("git", "log", "-1", "--format=%cI", "--", filepath.Base(file))
+	// run from the file's directory so files in submodules work too
+	cmd.Dir = filepath.Dir(file)
+	if out, err := cmd.Output(); err == nil {
+		if t, err := time.Parse(time.RFC3339, strings.TrimSpace(string(out))); err == nil {
+			return t
+		}
+	}
+	if info, err := os.Stat(file); err == nil {
+		return info.ModTime()
+	}
+	return time.Time{}
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+type atomEntry struct {
+	Title     string       `xml:"title"`
+	ID        string       `xml:"id"`
+	Link      atomLink     `xml:"link"`
+	Published string       `xml:"published"`
+	Updated   string       `xml:"updated"`
+	Summary   string       `xml:"summary,omitempty"`
+	Category  []atomCat    `xml:"category"`
+	Content   *atomContent `xml:"content"`
+}
+
+type atomCat struct {
+	Term string `xml:"term,attr"`
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Links   []atomLink  `xml:"link"`
+	Updated string      `xml:"updated"`
+	Author  string      `xml:"author>name"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+func AtomFeed(posts []*Post) ([]byte, error) {
+	feed := atomFeed{
+		Title: *feedTitle,
+		ID:    siteURL("/"),
+		Links: []atomLink{
+			{Href: siteURL("/atom.xml"), Rel: "self", Type: "application/atom+xml"},
+			{Href: siteURL("/"), Rel: "alternate", Type: "text/html"},
+		},
+		Updated: feedUpdated(posts).Format(time.RFC3339),
+		Author:  *feedAuthor,
+	}
+	for _, post := range posts {
+		content, err := postContent(post)
+		if err != nil {
+			return nil, err
+		}
+		entry := atomEntry{
+			Title:     post.Title,
+			ID:        pageURL(post.Path),
+			Link:      atomLink{Href: pageURL(post.Path), Rel: "alternate", Type: "text/html"},
+			Published: post.Date.Format(time.RFC3339),
+			Updated:   post.Updated.Format(time.RFC3339),
+			Summary:   post.Meta.Description,
+			Content:   &atomContent{Type: "html", Body: content},
+		}
+		for _, t := range post.Tags {
+			entry.Category = append(entry.Category, atomCat{t})
+		}
+		feed.Entries = append(feed.Entries, entry)
+	}
+	return marshalXML(feed)
+}
+
+type rssItem struct {
+	Title       string   `xml:"title"`
+	Link        string   `xml:"link"`
+	GUID        string   `xml:"guid"`
+	PubDate     string   `xml:"pubDate"`
+	Category    []string `xml:"category"`
+	Description string   `xml:"description"`
+}
+
+type rssFeed struct {
+	XMLName xml.Name `xml:"rss"`
+	Version string   `xml:"version,attr"`
+	Atom    string   `xml:"xmlns:atom,attr"`
+	Channel struct {
+		Title         string    `xml:"title"`
+		Link          string    `xml:"link"`
+		Self          atomLink  `xml:"atom:link"`
+		Description   string    `xml:"description"`
+		LastBuildDate string    `xml:"lastBuildDate"`
+		Items         []rssItem `xml:"item"`
+	} `xml:"channel"`
+}
+
+func RSSFeed(posts []*Post) ([]byte, error) {
+	feed := rssFeed{Version: "2.0", Atom: "http://www.w3.org/2005/Atom"}
+	feed.Channel.Title = *feedTitle
+	feed.Channel.Link = siteURL("/")
+	feed.Channel.Self = atomLink{Href: siteURL("/rss.xml"), Rel: "self", Type: "application/rss+xml"}
+	feed.Channel.Description = "Posts from " + DOMAIN_NAME
+	feed.Channel.LastBuildDate = feedUpdated(posts).Format(time.RFC1123Z)
+	for _, post := range posts {
+		content, err := postContent(post)
+		if err != nil {
+			return nil, err
+		}
+		feed.Channel.Items = append(feed.Channel.Items, rssItem{
+			Title:       post.Title,
+			Link:        pageURL(post.Path),
+			GUID:        pageURL(post.Path),
+			PubDate:     post.Date.Format(time.RFC1123Z),
+			Category:    post.Tags,
+			Description: content,
+		})
+	}
+	return marshalXML(feed)
+}
+
+func marshalXML(v interface{}) ([]byte, error) {
+	b, err := xml.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), b...), nil
+}
+
+type jsonFeedItem struct {
+	ID            string   `json:"id"`
+	URL           string   `json:"url"`
+	Title         string   `json:"title"`
+	ContentHTML   string   `json:"content_html"`
+	Summary       string   `json:"summary,omitempty"`
+	DatePublished string   `json:"date_published"`
+	DateModified  string   `json:"date_modified"`
+	Tags          []string `json:"tags,omitempty"`
+}
+
+type jsonFeedAuthor struct {
+	Name string `json:"name"`
+}
+
+type jsonFeed struct {
+	Version     string           `json:"version"`
+	Title       string           `json:"title"`
+	HomePageURL string           `json:"home_page_url"`
+	FeedURL     string           `json:"feed_url"`
+	Authors     []jsonFeedAuthor `json:"authors"`
+	Items       []jsonFeedItem   `json:"items"`
+}
+
+func JSONFeed(posts []*Post) ([]byte, error) {
+	feed := jsonFeed{
+		Version:     "https://jsonfeed.org/version/1.1",
+		Title:       *feedTitle,
+		HomePageURL: siteURL("/"),
+		FeedURL:     siteURL("/feed.json"),
+		Authors:     []jsonFeedAuthor{{*feedAuthor}},
+		Items:       []jsonFeedItem{},
+	}
+	for _, post := range posts {
+		content, err := postContent(post)
+		if err != nil {
+			return nil, err
+		}
+		feed.Items = append(feed.Items, jsonFeedItem{
+			ID:            pageURL(post.Path),
+			URL:           pageURL(post.Path),
+			Title:         post.Title,
+			ContentHTML:   content,
+			Summary:       post.Meta.Description,
+			DatePublished: post.Date.Format(time.RFC3339),
+			DateModified:  post.Updated.Format(time.RFC3339),
+			Tags:          post.Tags,
+		})
+	}
+	return json.MarshalIndent(&feed, "", "  ")
+}
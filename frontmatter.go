@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// FrontMatter is the metadata at the top of a Markdown file, either YAML
+// between "---" lines or TOML between "+++" lines
+type FrontMatter struct {
+	Title       string    `yaml:"title" toml:"title"`
+	Description string    `yaml:"description" toml:"description"`
+	Date        time.Time `yaml:"date" toml:"date"`
+	Updated     time.Time `yaml:"updated" toml:"updated"`
+	Tags        []string  `yaml:"tags" toml:"tags"`
+	Layout      string    `yaml:"layout" toml:"layout"`
+	Draft       bool      `yaml:"draft" toml:"draft"`
+	// add a table of contents even if the page has no [TOC] marker
+	TOC bool `yaml:"toc" toml:"toc"`
+
+	// every key, including ones not listed above, for use in templates
+	Params map[string]interface{} `yaml:"-" toml:"-"`
+}
+
+// ParseFrontMatter splits the front matter off of a Markdown file. Files
+// without front matter return a zero FrontMatter and b unchanged.
+func ParseFrontMatter(b []byte) (meta FrontMatter, body []byte, err error) {
+	var delim []byte
+	switch {
+	case bytes.HasPrefix(b, []byte("---\n")), bytes.HasPrefix(b, []byte("---\r\n")):
+		delim = []byte("---")
+	case bytes.HasPrefix(b, []byte("+++\n")), bytes.HasPrefix(b, []byte("+++\r\n")):
+		delim = []byte("+++")
+	default:
+		return meta, b, nil
+	}
+
+	start := bytes.IndexByte(b, '\n') + 1
+	end, next := -1, -1
+	for i := start; i < len(b); {
+		lineEnd := bytes.IndexByte(b[i:], '\n')
+		if lineEnd == -1 {
+			lineEnd = len(b)
+		} else {
+			lineEnd += i
+		}
+		if bytes.Equal(bytes.TrimRight(b[i:lineEnd], "\r"), delim) {
+			end, next = i, lineEnd+1
+			break
+		}
+		i = lineEnd + 1
+	}
+	if end == -1 {
+		// an unterminated "---" is probably just a horizontal rule
+		return meta, b, nil
+	}
+	if next > len(b) {
+		next = len(b)
+	}
+	raw := b[start:end]
+
+	if delim[0] == '-' {
+		if err := yaml.Unmarshal(raw, &meta); err != nil {
+			return meta, b, fmt.Errorf("invalid YAML front matter: %v", err)
+		}
+		params := make(map[string]interface{})
+		if err := yaml.Unmarshal(raw, &params); err != nil {
+			return meta, b, fmt.Errorf("invalid YAML front matter: %v", err)
+		}
+		meta.Params = params
+	} else {
+		if err := toml.Unmarshal(raw, &meta); err != nil {
+			return meta, b, fmt.Errorf("invalid TOML front matter: %v", err)
+		}
+		params := make(map[string]interface{})
+		if err := toml.Unmarshal(raw, &params); err != nil {
+			return meta, b, fmt.Errorf("invalid TOML front matter: %v", err)
+		}
+		meta.Params = params
+	}
+	return meta, b[next:], nil
+}
+
+// markdownTitle returns the text of the first heading in a Markdown file,
+// skipping over fenced code blocks
+func markdownTitle(b []byte) string {
+	inFence := false
+	for _, line := range bytes.Split(b, []byte("\n")) {
+		line = bytes.TrimRight(line, "\r")
+		trimmed := bytes.TrimLeft(line, " ")
+		if bytes.HasPrefix(trimmed, []byte("```")) || bytes.HasPrefix(trimmed, []byte("~~~")) {
+			inFence = !inFence
+			continue
+		}
+		if inFence || !bytes.HasPrefix(line, []byte("#")) {
+			continue
+		}
+		if text := bytes.TrimLeft(line, "#"); bytes.HasPrefix(text, []byte(" ")) {
+			return string(bytes.TrimSpace(text))
+		}
+	}
+	return ""
+}
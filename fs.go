@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	iofs "io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const STATIC_DIR = "static"
+
+var (
+	denyPatterns  = flag.String("deny", ".*", "comma separated path patterns that are never served; patterns without a slash match any path segment, so the default hides dotfiles and .git")
+	allowPatterns = flag.String("allow", "", "comma separated path patterns that are served even if they match -deny, e.g. /.well-known")
+)
+
+var (
+	errHiddenPath = errors.New("path refers to a hidden file")
+	errPathEscape = errors.New("path escapes the served directory")
+)
+
+// isHidden reports whether the cleaned, slash rooted path p is denied by
+// the -deny patterns without being let back in by the -allow patterns
+func isHidden(p string) bool {
+	return matchesAny(splitList(*denyPatterns), p) && !matchesAny(splitList(*allowPatterns), p)
+}
+
+// matchesAny reports whether any of the patterns matches p. Patterns
+// containing a slash are matched against p and all of its parent
+// directories, so "/drafts" covers everything below it; other patterns
+// are matched against each path segment.
+func matchesAny(patterns []string, p string) bool {
+	segments := strings.Split(strings.TrimPrefix(p, "/"), "/")
+	for _, pattern := range patterns {
+		if strings.Contains(pattern, "/") {
+			pattern = "/" + strings.TrimPrefix(pattern, "/")
+			prefix := ""
+			for _, segment := range segments {
+				prefix += "/" + segment
+				if ok, _ := path.Match(pattern, prefix); ok {
+					return true
+				}
+			}
+		} else {
+			for _, segment := range segments {
+				if ok, _ := path.Match(pattern, segment); ok {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// resolvePath maps a URL path onto a file inside root. The path is cleaned,
+// paths hidden by the -deny and -allow patterns are refused, and the result
+// must still be inside root after following symlinks. The returned path is
+// root joined with the cleaned URL path, not the symlink target, so callers
+// can keep deriving URLs from it.
+func resolvePath(root, urlPath string) (string, error) {
+	if strings.IndexByte(urlPath, 0) != -1 {
+		return "", errPathEscape
+	}
+	// rooting the path first means Clean can't produce a leading ".."
+	cleaned := path.Clean("/" + urlPath)
+	if isHidden(cleaned) {
+		return "", errHiddenPath
+	}
+
+	full := filepath.Join(root, filepath.FromSlash(cleaned))
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+	realFull, err := filepath.EvalSymlinks(full)
+	if err != nil {
+		// nonexistent files are reported by the caller's open
+		if os.IsNotExist(err) {
+			return full, nil
+		}
+		return "", err
+	}
+	rel, err := filepath.Rel(realRoot, realFull)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", errPathEscape
+	}
+	// a symlink to somewhere inside .git is just as bad as a direct path
+	if rel != "." && isHidden("/"+filepath.ToSlash(rel)) {
+		return "", errHiddenPath
+	}
+	return full, nil
+}
+
+// safeFS is an http.FileSystem that resolves every name with resolvePath
+// and leaves hidden files out of directory listings
+type safeFS string
+
+func (fs safeFS) Open(name string) (http.File, error) {
+	full, err := resolvePath(string(fs), name)
+	if err != nil {
+		// http.FileServer only knows how to report these two
+		if err == errHiddenPath {
+			return nil, os.ErrNotExist
+		}
+		return nil, os.ErrPermission
+	}
+	f, err := os.Open(full)
+	if err != nil {
+		return nil, err
+	}
+	return safeFile{f, path.Clean("/" + name)}, nil
+}
+
+type safeFile struct {
+	*os.File
+	urlPath string
+}
+
+func (f safeFile) Readdir(count int) ([]os.FileInfo, error) {
+	infos, err := f.File.Readdir(count)
+	visible := infos[:0]
+	for _, info := range infos {
+		if !isHidden(path.Join(f.urlPath, info.Name())) {
+			visible = append(visible, info)
+		}
+	}
+	return visible, err
+}
+
+func (f safeFile) ReadDir(count int) ([]iofs.DirEntry, error) {
+	entries, err := f.File.ReadDir(count)
+	visible := entries[:0]
+	for _, entry := range entries {
+		if !isHidden(path.Join(f.urlPath, entry.Name())) {
+			visible = append(visible, entry)
+		}
+	}
+	return visible, err
+}
+
+var staticFS = safeFS(STATIC_DIR)
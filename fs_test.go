@@ -0,0 +1,165 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testRoot makes a static/ directory with a few files, hidden files and
+// symlinks, next to a directory that must never be reachable from it
+func testRoot(t testing.TB) string {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "static")
+	outside := filepath.Join(dir, "outside")
+	for _, d := range []string{root, outside, filepath.Join(root, "sub"), filepath.Join(root, ".git"), filepath.Join(root, ".well-known", "acme-challenge")} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := []string{
+		filepath.Join(root, "index.md"),
+		filepath.Join(root, "sub", "page.md"),
+		filepath.Join(root, ".env"),
+		filepath.Join(root, ".git", "config"),
+		filepath.Join(root, ".well-known", "acme-challenge", "token"),
+		filepath.Join(outside, "secret"),
+	}
+	for _, f := range files {
+		if err := os.WriteFile(f, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		filepath.Join(root, "escape"):         outside,
+		filepath.Join(root, "sub", "up"):      "../..",
+		filepath.Join(root, "git"):            ".git",
+		filepath.Join(root, "sub", "sibling"): "page.md",
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, link); err != nil {
+			t.Skipf("symlinks unsupported: %v", err)
+		}
+	}
+	return root
+}
+
+func FuzzResolvePath(f *testing.F) {
+	for _, seed := range []string{
+		"/", "..", "/..", "../outside/secret", "/../../outside/secret", "/sub/../../outside/secret",
+		"%2e%2e", "/%2e%2e/outside/secret", "/%2E%2E%2Foutside%2Fsecret",
+		"/index.md\x00", "/\x00/../outside/secret", "\x00",
+		"/.env", "/.git", "/.git/config", "/sub/../.git/config", "/./.git/./config", "/git/config",
+		"/escape", "/escape/secret", "/sub/up/outside/secret", "/sub/sibling", "/sub//page.md",
+		"\\..\\outside\\secret", "/.well-known/acme-challenge/token",
+	} {
+		f.Add(seed)
+	}
+	root := testRoot(f)
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	f.Fuzz(func(t *testing.T, urlPath string) {
+		full, err := resolvePath(root, urlPath)
+		if err != nil {
+			return
+		}
+		if strings.IndexByte(urlPath, 0) != -1 {
+			t.Fatalf("%q: path with a NUL byte resolved to %s", urlPath, full)
+		}
+		rel, err := filepath.Rel(root, full)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			t.Fatalf("%q: resolved to %s, outside %s", urlPath, full, root)
+		}
+		if rel != "." && isHidden("/"+filepath.ToSlash(rel)) {
+			t.Fatalf("%q: resolved to hidden file %s", urlPath, full)
+		}
+		// whatever the path names has to be inside static/ too
+		realFull, err := filepath.EvalSymlinks(full)
+		if err != nil {
+			return
+		}
+		rel, err = filepath.Rel(realRoot, realFull)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			t.Fatalf("%q: resolved to %s, which is really %s outside %s", urlPath, full, realFull, realRoot)
+		}
+		if rel != "." && isHidden("/"+filepath.ToSlash(rel)) {
+			t.Fatalf("%q: resolved to %s, which is really hidden file %s", urlPath, full, realFull)
+		}
+	})
+}
+
+func TestResolvePath(t *testing.T) {
+	root := testRoot(t)
+	defer func(deny, allow string) { *denyPatterns, *allowPatterns = deny, allow }(*denyPatterns, *allowPatterns)
+
+	tests := []struct {
+		name  string
+		deny  string
+		allow string
+		path  string
+		want  string
+		err   error
+	}{
+		{name: "plain file", deny: ".*", path: "/sub/page.md", want: "sub/page.md"},
+		{name: "cleaned", deny: ".*", path: "/sub/../index.md", want: "index.md"},
+		{name: "dot dot can't leave root", deny: ".*", path: "/../../index.md", want: "index.md"},
+		{name: "missing file", deny: ".*", path: "/nope.md", want: "nope.md"},
+		{name: "symlink inside root", deny: ".*", path: "/sub/sibling", want: "sub/sibling"},
+		{name: "symlink to outside root", deny: ".*", path: "/escape/secret", err: errPathEscape},
+		{name: "symlink to directory outside root", deny: ".*", path: "/escape", err: errPathEscape},
+		{name: "relative symlink out of root", deny: ".*", path: "/sub/up/outside/secret", err: errPathEscape},
+		{name: "symlink to hidden directory", deny: ".*", path: "/git/config", err: errHiddenPath},
+		{name: "dotfile", deny: ".*", path: "/.env", err: errHiddenPath},
+		{name: "git directory", deny: ".*", path: "/.git/config", err: errHiddenPath},
+		{name: "NUL byte", deny: ".*", path: "/index.md\x00.png", err: errPathEscape},
+		{name: "denied without allow", deny: ".*", path: "/.well-known/acme-challenge/token", err: errHiddenPath},
+		{name: "allow overrides deny", deny: ".*", allow: "/.well-known", path: "/.well-known/acme-challenge/token", want: ".well-known/acme-challenge/token"},
+		{name: "allow only covers its own path", deny: ".*", allow: "/.well-known", path: "/.git/config", err: errHiddenPath},
+		{name: "deny by directory", deny: ".*,/sub", path: "/sub/page.md", err: errHiddenPath},
+		{name: "allow inside denied directory", deny: ".*,/sub", allow: "/sub/page.md", path: "/sub/page.md", want: "sub/page.md"},
+	}
+	for _, test := range tests {
+		*denyPatterns, *allowPatterns = test.deny, test.allow
+		got, err := resolvePath(root, test.path)
+		if test.err != nil {
+			if err != test.err {
+				t.Errorf("%s: resolvePath(%q) = %q, %v; want error %v", test.name, test.path, got, err, test.err)
+			}
+			continue
+		}
+		want := filepath.Join(root, filepath.FromSlash(test.want))
+		if err != nil || got != want {
+			t.Errorf("%s: resolvePath(%q) = %q, %v; want %q", test.name, test.path, got, err, want)
+		}
+	}
+}
+
+func TestSafeFSHidesFiles(t *testing.T) {
+	root := testRoot(t)
+	fs := safeFS(root)
+	if _, err := fs.Open("/.git/config"); !os.IsNotExist(err) {
+		t.Errorf("opening /.git/config: got %v, want a not exist error", err)
+	}
+	if _, err := fs.Open("/escape/secret"); !os.IsPermission(err) {
+		t.Errorf("opening /escape/secret: got %v, want a permission error", err)
+	}
+
+	dir, err := fs.Open("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dir.Close()
+	infos, err := dir.Readdir(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, info := range infos {
+		if strings.HasPrefix(info.Name(), ".") {
+			t.Errorf("directory listing includes hidden %s", info.Name())
+		}
+	}
+}
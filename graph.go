@@ -0,0 +1,493 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"math"
+	"sort"
+	"strconv"
+	"unicode/utf8"
+)
+
+// a small layered graph layout, enough for the flowcharts and state
+// diagrams that show up in project writeups, drawn straight to SVG
+
+const (
+	GRAPH_FONT_SIZE  = 14
+	GRAPH_CHAR_WIDTH = 7.5
+	GRAPH_NODE_GAP   = 30
+	GRAPH_LAYER_GAP  = 50
+	GRAPH_MARGIN     = 10
+)
+
+type graphNode struct {
+	id    string
+	label string
+	// box, rounded, ellipse, circle, diamond or plain
+	shape string
+
+	layer, order int
+	x, y, w, h   float64
+}
+
+type graphEdge struct {
+	from, to *graphNode
+	label    string
+	directed bool
+	// solid, dashed, dotted or bold
+	style string
+}
+
+type graph struct {
+	// TB, BT, LR or RL
+	direction string
+	nodes     []*graphNode
+	byID      map[string]*graphNode
+	edges     []*graphEdge
+}
+
+func newGraph() *graph {
+	return &graph{direction: "TB", byID: make(map[string]*graphNode)}
+}
+
+// node returns the node with id, adding it if it's new
+func (g *graph) node(id string) *graphNode {
+	if n, ok := g.byID[id]; ok {
+		return n
+	}
+	n := &graphNode{id: id, label: id, shape: "box"}
+	g.byID[id] = n
+	g.nodes = append(g.nodes, n)
+	return n
+}
+
+func (g *graph) addEdge(from, to string, directed bool) *graphEdge {
+	e := &graphEdge{from: g.node(from), to: g.node(to), directed: directed, style: "solid"}
+	g.edges = append(g.edges, e)
+	return e
+}
+
+// layout assigns every node a position
+func (g *graph) layout() {
+	g.assignLayers()
+	g.orderLayers()
+
+	for _, n := range g.nodes {
+		textWidth := float64(utf8.RuneCountInString(n.label))*GRAPH_CHAR_WIDTH + 24
+		n.w, n.h = math.Max(60, textWidth), 36
+		switch n.shape {
+		case "diamond":
+			n.w, n.h = n.w*1.4, n.h*1.6
+		case "circle":
+			n.w = math.Max(n.w, n.h)
+			n.h = n.w
+		case "ellipse":
+			n.w, n.h = n.w*1.15, n.h*1.1
+		}
+	}
+
+	horizontal := g.direction == "LR" || g.direction == "RL"
+	// sizes along and across the layers
+	along := func(n *graphNode) float64 {
+		if horizontal {
+			return n.w
+		}
+		return n.h
+	}
+	across := func(n *graphNode) float64 {
+		if horizontal {
+			return n.h
+		}
+		return n.w
+	}
+
+	layerGap := float64(GRAPH_LAYER_GAP)
+	for _, e := range g.edges {
+		if len(e.label) > 0 {
+			layerGap += GRAPH_FONT_SIZE * 1.5
+			if horizontal {
+				layerGap += 30
+			}
+			break
+		}
+	}
+
+	layers := g.layers()
+	widest := 0.0
+	spans := make([]float64, len(layers))
+	for i, layer := range layers {
+		for j, n := range layer {
+			if j > 0 {
+				spans[i] += GRAPH_NODE_GAP
+			}
+			spans[i] += across(n)
+		}
+		widest = math.Max(widest, spans[i])
+	}
+
+	pos := 0.0
+	for i, layer := range layers {
+		depth := 0.0
+		for _, n := range layer {
+			depth = math.Max(depth, along(n))
+		}
+		offset := (widest - spans[i]) / 2
+		for _, n := range layer {
+			a := pos + depth/2
+			b := offset + across(n)/2
+			offset += across(n) + GRAPH_NODE_GAP
+			if horizontal {
+				n.x, n.y = a, b
+			} else {
+				n.x, n.y = b, a
+			}
+		}
+		pos += depth + layerGap
+	}
+
+	// flip for bottom to top and right to left
+	total := pos - layerGap
+	for _, n := range g.nodes {
+		switch g.direction {
+		case "BT":
+			n.y = total - n.y
+		case "RL":
+			n.x = total - n.x
+		}
+		n.x += GRAPH_MARGIN
+		n.y += GRAPH_MARGIN
+	}
+}
+
+// assignLayers puts every node one layer below the furthest of its
+// predecessors, ignoring the edges that close cycles
+func (g *graph) assignLayers() {
+	index := make(map[*graphNode]int)
+	for i, n := range g.nodes {
+		index[n] = i
+	}
+	out := make([][]*graphEdge, len(g.nodes))
+	for _, e := range g.edges {
+		out[index[e.from]] = append(out[index[e.from]], e)
+	}
+
+	// find the back edges with a depth first search
+	back := make(map[*graphEdge]bool)
+	state := make([]int, len(g.nodes))
+	var visit func(i int)
+	visit = func(i int) {
+		state[i] = 1
+		for _, e := range out[i] {
+			j := index[e.to]
+			switch state[j] {
+			case 0:
+				visit(j)
+			case 1:
+				back[e] = true
+			}
+		}
+		state[i] = 2
+	}
+	for i := range g.nodes {
+		if state[i] == 0 {
+			visit(i)
+		}
+	}
+
+	// longest path layering, in topological order
+	indegree := make([]int, len(g.nodes))
+	for _, e := range g.edges {
+		if !back[e] && e.from != e.to {
+			indegree[index[e.to]]++
+		}
+	}
+	var queue []int
+	for i, d := range indegree {
+		if d == 0 {
+			queue = append(queue, i)
+		}
+	}
+	for len(queue) > 0 {
+		i := queue[0]
+		queue = queue[1:]
+		for _, e := range out[i] {
+			if back[e] || e.from == e.to {
+				continue
+			}
+			j := index[e.to]
+			if g.nodes[i].layer+1 > g.nodes[j].layer {
+				g.nodes[j].layer = g.nodes[i].layer + 1
+			}
+			indegree[j]--
+			if indegree[j] == 0 {
+				queue = append(queue, j)
+			}
+		}
+	}
+}
+
+func (g *graph) layers() [][]*graphNode {
+	var layers [][]*graphNode
+	for _, n := range g.nodes {
+		for len(layers) <= n.layer {
+			layers = append(layers, nil)
+		}
+		layers[n.layer] = append(layers[n.layer], n)
+	}
+	for _, layer := range layers {
+		sort.SliceStable(layer, func(i, j int) bool { return layer[i].order < layer[j].order })
+	}
+	return layers
+}
+
+// orderLayers reduces edge crossings by sorting each layer by the average
+// position of its neighbours in the layer before, then the layer after
+func (g *graph) orderLayers() {
+	layers := g.layers()
+	for _, layer := range layers {
+		for i, n := range layer {
+			n.order = i
+		}
+	}
+	neighbours := make(map[*graphNode][]*graphNode)
+	for _, e := range g.edges {
+		neighbours[e.from] = append(neighbours[e.from], e.to)
+		neighbours[e.to] = append(neighbours[e.to], e.from)
+	}
+
+	sweep := func(layer []*graphNode, adjacent int) {
+		bary := make(map[*graphNode]float64)
+		for _, n := range layer {
+			sum, count := 0.0, 0
+			for _, m := range neighbours[n] {
+				if m.layer == adjacent {
+					sum += float64(m.order)
+					count++
+				}
+			}
+			if count > 0 {
+				bary[n] = sum / float64(count)
+			} else {
+				bary[n] = float64(n.order)
+			}
+		}
+		sort.SliceStable(layer, func(i, j int) bool { return bary[layer[i]] < bary[layer[j]] })
+		for i, n := range layer {
+			n.order = i
+		}
+	}
+	for pass := 0; pass < 4; pass++ {
+		for i := 1; i < len(layers); i++ {
+			sweep(layers[i], i-1)
+		}
+		for i := len(layers) - 2; i >= 0; i-- {
+			sweep(layers[i], i+1)
+		}
+	}
+}
+
+func svgNum(f float64) string {
+	return strconv.FormatFloat(math.Round(f*10)/10, 'f', -1, 64)
+}
+
+// boundary returns how far along the vector (dx, dy) from the centre of n
+// its outline is, as a fraction of the vector
+func (n *graphNode) boundary(dx, dy float64) float64 {
+	hw, hh := n.w/2, n.h/2
+	switch n.shape {
+	case "ellipse", "circle":
+		return 1 / math.Sqrt(dx*dx/(hw*hw)+dy*dy/(hh*hh))
+	case "diamond":
+		return 1 / (math.Abs(dx)/hw + math.Abs(dy)/hh)
+	}
+	return math.Min(hw/math.Abs(dx), hh/math.Abs(dy))
+}
+
+// edgeRoute is the line an edge is drawn along: a straight line from p[0]
+// to p[3], or a cubic Bézier curve through all four points
+type edgeRoute struct {
+	p      [4][2]float64
+	curved bool
+}
+
+// route finds the path for e. Edges between neighbouring layers are drawn
+// straight; edges that skip layers, go backwards or stay in one layer
+// would cross the nodes in between, so they curve around the side instead.
+func (g *graph) route(e *graphEdge, paired bool) edgeRoute {
+	from, to := e.from, e.to
+	horizontal := g.direction == "LR" || g.direction == "RL"
+
+	if from == to {
+		if horizontal {
+			x, y := from.x, from.y+from.h/2
+			return edgeRoute{[4][2]float64{{x - 8, y}, {x - 25, y + 35}, {x + 25, y + 35}, {x + 8, y}}, true}
+		}
+		x, y := from.x+from.w/2, from.y
+		return edgeRoute{[4][2]float64{{x, y - 8}, {x + 35, y - 25}, {x + 35, y + 25}, {x, y + 8}}, true}
+	}
+
+	if from.layer-to.layer == 1 || to.layer-from.layer == 1 {
+		dx, dy := to.x-from.x, to.y-from.y
+		t1, t2 := from.boundary(dx, dy), to.boundary(dx, dy)
+		x1, y1 := from.x+dx*t1, from.y+dy*t1
+		x2, y2 := to.x-dx*t2, to.y-dy*t2
+		if paired {
+			// keep edges going both ways between two nodes apart
+			l := math.Hypot(dx, dy)
+			ox, oy := -dy/l*5, dx/l*5
+			x1, y1, x2, y2 = x1+ox, y1+oy, x2+ox, y2+oy
+		}
+		return edgeRoute{p: [4][2]float64{{x1, y1}, {}, {}, {x2, y2}}}
+	}
+
+	lo, hi := from.layer, to.layer
+	if lo > hi {
+		lo, hi = hi, lo
+	}
+	clearance := 30.0
+	if paired && from.layer > to.layer {
+		clearance += 15
+	}
+	if horizontal {
+		// below the nodes in the way
+		bottom := 0.0
+		for _, n := range g.nodes {
+			if lo <= n.layer && n.layer <= hi {
+				bottom = math.Max(bottom, n.y+n.h/2)
+			}
+		}
+		cy := bottom + clearance
+		x1, y1 := from.x, from.y+from.h/2
+		x2, y2 := to.x, to.y+to.h/2
+		return edgeRoute{[4][2]float64{{x1, y1}, {x1, cy}, {x2, cy}, {x2, y2}}, true}
+	}
+	// to the right of the nodes in the way
+	right := 0.0
+	for _, n := range g.nodes {
+		if lo <= n.layer && n.layer <= hi {
+			right = math.Max(right, n.x+n.w/2)
+		}
+	}
+	cx := right + clearance
+	x1, y1 := from.x+from.w/2, from.y
+	x2, y2 := to.x+to.w/2, to.y
+	return edgeRoute{[4][2]float64{{x1, y1}, {cx, y1}, {cx, y2}, {x2, y2}}, true}
+}
+
+// midpoint returns where an edge's label goes
+func (r edgeRoute) midpoint() (float64, float64) {
+	p := r.p
+	if !r.curved {
+		return (p[0][0] + p[3][0]) / 2, (p[0][1] + p[3][1]) / 2
+	}
+	return 0.125*p[0][0] + 0.375*p[1][0] + 0.375*p[2][0] + 0.125*p[3][0],
+		0.125*p[0][1] + 0.375*p[1][1] + 0.375*p[2][1] + 0.125*p[3][1]
+}
+
+// SVG draws the laid out graph; id has to be unique on the page, since
+// it's used to name the arrowheads
+func (g *graph) SVG(id string) []byte {
+	reversed := make(map[[2]*graphNode]bool)
+	for _, e := range g.edges {
+		reversed[[2]*graphNode{e.to, e.from}] = true
+	}
+	routes := make([]edgeRoute, len(g.edges))
+	for i, e := range g.edges {
+		routes[i] = g.route(e, reversed[[2]*graphNode{e.from, e.to}])
+	}
+
+	width, height := 0.0, 0.0
+	for _, n := range g.nodes {
+		width = math.Max(width, n.x+n.w/2+GRAPH_MARGIN)
+		height = math.Max(height, n.y+n.h/2+GRAPH_MARGIN)
+	}
+	// curves are inside the hull of their points
+	for i, r := range routes {
+		for _, p := range r.p {
+			width = math.Max(width, p[0]+GRAPH_MARGIN)
+			height = math.Max(height, p[1]+GRAPH_MARGIN)
+		}
+		if label := g.edges[i].label; len(label) > 0 {
+			x, y := r.midpoint()
+			width = math.Max(width, x+labelWidth(label)/2+GRAPH_MARGIN)
+			height = math.Max(height, y+9+GRAPH_MARGIN)
+		}
+	}
+
+	arrow := id + "-arrow"
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %s %s" width="%s" height="%s" role="img">`,
+		svgNum(width), svgNum(height), svgNum(width), svgNum(height))
+	fmt.Fprintf(&b, `<defs><marker id="%s" viewBox="0 0 10 10" refX="10" refY="5" markerWidth="8" markerHeight="8" orient="auto">`+
+		`<path d="M0,0 L10,5 L0,10 z" fill="#57606a"/></marker></defs>`, arrow)
+	for i, e := range g.edges {
+		writeGraphEdge(&b, e, routes[i], arrow)
+	}
+	for _, n := range g.nodes {
+		writeGraphNode(&b, n)
+	}
+	b.WriteString("</svg>")
+	return b.Bytes()
+}
+
+func writeGraphEdge(b *bytes.Buffer, e *graphEdge, r edgeRoute, arrow string) {
+	attrs := `fill="none" stroke="#57606a" stroke-width="1.5"`
+	switch e.style {
+	case "dashed":
+		attrs += ` stroke-dasharray="6,4"`
+	case "dotted":
+		attrs += ` stroke-dasharray="2,3"`
+	case "bold":
+		attrs = `fill="none" stroke="#57606a" stroke-width="3"`
+	}
+	if e.directed {
+		attrs += ` marker-end="url(#` + arrow + `)"`
+	}
+
+	p := r.p
+	if r.curved {
+		fmt.Fprintf(b, `<path class="diagram-edge" d="M%s,%s C%s,%s %s,%s %s,%s" %s/>`,
+			svgNum(p[0][0]), svgNum(p[0][1]), svgNum(p[1][0]), svgNum(p[1][1]),
+			svgNum(p[2][0]), svgNum(p[2][1]), svgNum(p[3][0]), svgNum(p[3][1]), attrs)
+	} else {
+		fmt.Fprintf(b, `<path class="diagram-edge" d="M%s,%s L%s,%s" %s/>`,
+			svgNum(p[0][0]), svgNum(p[0][1]), svgNum(p[3][0]), svgNum(p[3][1]), attrs)
+	}
+
+	if len(e.label) > 0 {
+		x, y := r.midpoint()
+		w := labelWidth(e.label)
+		fmt.Fprintf(b, `<rect x="%s" y="%s" width="%s" height="18" fill="#ffffff"/>`,
+			svgNum(x-w/2), svgNum(y-9), svgNum(w))
+		fmt.Fprintf(b, `<text x="%s" y="%s" text-anchor="middle" dominant-baseline="central" font-family="sans-serif" font-size="%d" fill="#57606a">%s</text>`,
+			svgNum(x), svgNum(y), GRAPH_FONT_SIZE-2, html.EscapeString(e.label))
+	}
+}
+
+func labelWidth(label string) float64 {
+	return float64(utf8.RuneCountInString(label))*GRAPH_CHAR_WIDTH*0.9 + 8
+}
+
+func writeGraphNode(b *bytes.Buffer, n *graphNode) {
+	const attrs = `fill="#f6f8fa" stroke="#57606a" stroke-width="1.5"`
+	x, y, hw, hh := n.x, n.y, n.w/2, n.h/2
+	switch n.shape {
+	case "ellipse", "circle":
+		fmt.Fprintf(b, `<ellipse class="diagram-node" cx="%s" cy="%s" rx="%s" ry="%s" %s/>`,
+			svgNum(x), svgNum(y), svgNum(hw), svgNum(hh), attrs)
+	case "diamond":
+		fmt.Fprintf(b, `<polygon class="diagram-node" points="%s,%s %s,%s %s,%s %s,%s" %s/>`,
+			svgNum(x), svgNum(y-hh), svgNum(x+hw), svgNum(y), svgNum(x), svgNum(y+hh), svgNum(x-hw), svgNum(y), attrs)
+	case "rounded":
+		fmt.Fprintf(b, `<rect class="diagram-node" x="%s" y="%s" width="%s" height="%s" rx="12" %s/>`,
+			svgNum(x-hw), svgNum(y-hh), svgNum(n.w), svgNum(n.h), attrs)
+	case "plain":
+	default:
+		fmt.Fprintf(b, `<rect class="diagram-node" x="%s" y="%s" width="%s" height="%s" rx="2" %s/>`,
+			svgNum(x-hw), svgNum(y-hh), svgNum(n.w), svgNum(n.h), attrs)
+	}
+	fmt.Fprintf(b, `<text x="%s" y="%s" text-anchor="middle" dominant-baseline="central" font-family="sans-serif" font-size="%d" fill="#24292f">%s</text>`,
+		svgNum(x), svgNum(y), GRAPH_FONT_SIZE, html.EscapeString(n.label))
+}
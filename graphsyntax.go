@@ -0,0 +1,497 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+var errEmptyDiagram = errors.New("the diagram has no nodes")
+
+var htmlTag = regexp.MustCompile(`<[^>]*>`)
+
+// diagramID names a diagram after its source, so the ids inside it are
+// unique on the page but don't change between renders
+func diagramID(src []byte) string {
+	sum := sha256.Sum256(src)
+	return "diagram-" + hex.EncodeToString(sum[:4])
+}
+
+func drawGraph(g *graph, src []byte) ([]byte, error) {
+	if len(g.nodes) == 0 {
+		return nil, errEmptyDiagram
+	}
+	g.layout()
+	return g.SVG(diagramID(src)), nil
+}
+
+// renderFlowchart renders the flowchart subset of mermaid's syntax:
+//
+//	graph LR
+//	  A[Square] -->|label| B(Rounded)
+//	  B --> C{Decision}
+//	  C -.-> D((Circle))
+func renderFlowchart(src []byte) ([]byte, error) {
+	g, err := parseFlowchart(string(src))
+	if err != nil {
+		return nil, err
+	}
+	return drawGraph(g, src)
+}
+
+var (
+	flowchartHeader = regexp.MustCompile(`^(?:graph|flowchart)(?:\s+(TB|TD|BT|LR|RL))?\s*;?$`)
+	flowchartID     = regexp.MustCompile(`^[\p{L}\p{N}_]+`)
+	// links like -->, ---, -.->, ==>, <-->, --o, --x and --> |label|
+	flowchartLink = regexp.MustCompile(`^(<)?(-{2,}|={2,}|-\.+-)([>ox])?(?:\s*\|([^|]*)\|)?`)
+	// links with the label inline, like -- label --> or -. label .->
+	flowchartLabelLink = regexp.MustCompile(`^(--|==|-\.)\s+([^|>]+?)\s+(-{2,}>|={2,}>|\.->|-{3,}|={3,}|\.-)`)
+)
+
+// flowchart node shapes, by opening bracket, longest first
+var flowchartShapes = []struct{ open, close, shape string }{
+	{"(((", ")))", "circle"},
+	{"((", "))", "circle"},
+	{"([", "])", "rounded"},
+	{"[[", "]]", "box"},
+	{"[(", ")]", "box"},
+	{"{{", "}}", "diamond"},
+	{"[", "]", "box"},
+	{"(", ")", "rounded"},
+	{"{", "}", "diamond"},
+	{">", "]", "box"},
+}
+
+func parseFlowchart(src string) (*graph, error) {
+	g := newGraph()
+	first := true
+	for lineNum, line := range strings.Split(src, "\n") {
+		line = strings.TrimSpace(line)
+		if i := strings.Index(line, "%%"); i != -1 {
+			line = strings.TrimSpace(line[:i])
+		}
+		if len(line) == 0 {
+			continue
+		}
+		if first {
+			first = false
+			if m := flowchartHeader.FindStringSubmatch(line); m != nil {
+				switch m[1] {
+				case "", "TD":
+					g.direction = "TB"
+				default:
+					g.direction = m[1]
+				}
+				continue
+			}
+		}
+		for _, stmt := range strings.Split(line, ";") {
+			if err := parseFlowchartStatement(g, strings.TrimSpace(stmt)); err != nil {
+				return nil, fmt.Errorf("line %d: %v", lineNum+1, err)
+			}
+		}
+	}
+	return g, nil
+}
+
+func parseFlowchartStatement(g *graph, stmt string) error {
+	if len(stmt) == 0 {
+		return nil
+	}
+	switch strings.Fields(stmt)[0] {
+	case "classDef", "class", "style", "linkStyle", "click", "subgraph", "end", "direction":
+		// styling and grouping aren't supported, but shouldn't break the diagram
+		return nil
+	}
+
+	rest := stmt
+	var prev *graphNode
+	var link *graphEdge
+	for {
+		n, remaining, err := parseFlowchartNode(g, rest)
+		if err != nil {
+			return err
+		}
+		rest = strings.TrimSpace(remaining)
+		if link != nil {
+			link.to = n
+			g.edges = append(g.edges, link)
+		}
+		prev = n
+		if len(rest) == 0 {
+			return nil
+		}
+
+		link = &graphEdge{from: prev, style: "solid"}
+		var op string
+		if m := flowchartLabelLink.FindStringSubmatch(rest); m != nil {
+			op = m[1] + m[3]
+			link.label = strings.Trim(m[2], `"`)
+			link.directed = strings.HasSuffix(m[3], ">")
+			rest = rest[len(m[0]):]
+		} else if m := flowchartLink.FindStringSubmatch(rest); m != nil {
+			op = m[2]
+			link.label = strings.Trim(strings.TrimSpace(m[4]), `"`)
+			link.directed = len(m[3]) > 0 || len(m[1]) > 0
+			rest = rest[len(m[0]):]
+		} else {
+			return fmt.Errorf("expected a link at %q", rest)
+		}
+		switch {
+		case strings.Contains(op, "."):
+			link.style = "dashed"
+		case strings.HasPrefix(op, "="):
+			link.style = "bold"
+		}
+		rest = strings.TrimSpace(rest)
+		if len(rest) == 0 {
+			return errors.New("link without a target")
+		}
+	}
+}
+
+// parseFlowchartNode parses a node reference like A or A[Label], returning
+// the rest of the statement
+func parseFlowchartNode(g *graph, s string) (*graphNode, string, error) {
+	id := flowchartID.FindString(s)
+	if len(id) == 0 {
+		return nil, "", fmt.Errorf("expected a node at %q", s)
+	}
+	s = s[len(id):]
+	n := g.node(id)
+
+	for _, shape := range flowchartShapes {
+		if !strings.HasPrefix(s, shape.open) {
+			continue
+		}
+		end := strings.Index(s[len(shape.open):], shape.close)
+		if end == -1 {
+			return nil, "", fmt.Errorf("unclosed %q in node %s", shape.open, id)
+		}
+		label := strings.TrimSpace(s[len(shape.open) : len(shape.open)+end])
+		n.label = strings.Trim(label, `"`)
+		n.shape = shape.shape
+		s = s[len(shape.open)+end+len(shape.close):]
+		break
+	}
+	return n, s, nil
+}
+
+// renderDot renders the common subset of graphviz's dot language: graphs
+// and digraphs, node and edge statements with label, shape and style
+// attributes, default attributes and rankdir. Subgraphs are flattened.
+func renderDot(src []byte) ([]byte, error) {
+	g, err := parseDot(string(src))
+	if err != nil {
+		return nil, err
+	}
+	return drawGraph(g, src)
+}
+
+type dotParser struct {
+	tokens   []string
+	pos      int
+	g        *graph
+	directed bool
+	// default attributes from node [...] and edge [...] statements
+	nodeAttrs map[string]string
+	edgeAttrs map[string]string
+}
+
+func parseDot(src string) (*graph, error) {
+	tokens, err := dotTokens(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &dotParser{tokens: tokens, g: newGraph(),
+		nodeAttrs: map[string]string{"shape": "ellipse"}, edgeAttrs: map[string]string{}}
+
+	if p.peek() == "strict" {
+		p.pos++
+	}
+	switch p.next() {
+	case "digraph":
+		p.directed = true
+	case "graph":
+	default:
+		return nil, errors.New(`expected "graph" or "digraph"`)
+	}
+	if p.peek() != "{" {
+		p.next()
+	}
+	if p.next() != "{" {
+		return nil, errors.New(`expected "{"`)
+	}
+	if err := p.statements(); err != nil {
+		return nil, err
+	}
+	return p.g, nil
+}
+
+// dotTokens splits dot source into identifiers, quoted strings (kept with
+// their quotes) and punctuation, dropping comments
+func dotTokens(src string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case unicode.IsSpace(rune(c)):
+			i++
+		case strings.HasPrefix(src[i:], "//") || c == '#':
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(src[i:], "/*"):
+			end := strings.Index(src[i+2:], "*/")
+			if end == -1 {
+				return nil, errors.New("unclosed comment")
+			}
+			i += end + 4
+		case c == '"':
+			j := i + 1
+			for j < len(src) && src[j] != '"' {
+				if src[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(src) {
+				return nil, errors.New("unclosed string")
+			}
+			tokens = append(tokens, src[i:j+1])
+			i = j + 1
+		case c == '<':
+			// HTML labels, which are drawn as their text
+			depth, j := 0, i
+			for ; j < len(src); j++ {
+				if src[j] == '<' {
+					depth++
+				} else if src[j] == '>' {
+					depth--
+					if depth == 0 {
+						break
+					}
+				}
+			}
+			if j >= len(src) {
+				return nil, errors.New("unclosed HTML label")
+			}
+			text := htmlTag.ReplaceAllString(src[i+1:j], " ")
+			tokens = append(tokens, `"`+strings.Join(strings.Fields(text), " ")+`"`)
+			i = j + 1
+		case strings.HasPrefix(src[i:], "->") || strings.HasPrefix(src[i:], "--"):
+			tokens = append(tokens, src[i:i+2])
+			i += 2
+		case strings.IndexByte("{}[];,=:", c) != -1:
+			tokens = append(tokens, src[i:i+1])
+			i++
+		default:
+			j := i
+			for j < len(src) && !unicode.IsSpace(rune(src[j])) && strings.IndexByte("{}[];,=:\"<#", src[j]) == -1 &&
+				!strings.HasPrefix(src[j:], "->") && !strings.HasPrefix(src[j:], "--") && !strings.HasPrefix(src[j:], "//") {
+				j++
+			}
+			tokens = append(tokens, src[i:j])
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+func (p *dotParser) peek() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *dotParser) next() string {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+// unquote returns the value of an identifier or quoted string token
+func unquote(t string) string {
+	if len(t) >= 2 && t[0] == '"' {
+		t = t[1 : len(t)-1]
+		t = strings.NewReplacer(`\"`, `"`, `\n`, " ", `\l`, " ", `\r`, " ", `\\`, `\`).Replace(t)
+	}
+	return t
+}
+
+// statements parses statements up to the closing brace
+func (p *dotParser) statements() error {
+	for {
+		switch t := p.peek(); t {
+		case "":
+			return errors.New(`expected "}"`)
+		case "}":
+			p.pos++
+			return nil
+		case ";", ",":
+			p.pos++
+		case "subgraph", "{":
+			if t == "subgraph" {
+				p.pos++
+				if p.peek() != "{" {
+					p.next()
+				}
+			}
+			if p.next() != "{" {
+				return errors.New(`expected "{" after subgraph`)
+			}
+			if err := p.statements(); err != nil {
+				return err
+			}
+		case "graph", "node", "edge":
+			p.pos++
+			attrs, err := p.attributes()
+			if err != nil {
+				return err
+			}
+			switch t {
+			case "graph":
+				p.graphAttrs(attrs)
+			case "node":
+				for k, v := range attrs {
+					p.nodeAttrs[k] = v
+				}
+			case "edge":
+				for k, v := range attrs {
+					p.edgeAttrs[k] = v
+				}
+			}
+		default:
+			if err := p.statement(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// statement parses a graph attribute, node or edge statement
+func (p *dotParser) statement() error {
+	id := unquote(p.next())
+	if p.peek() == "=" {
+		p.pos++
+		p.graphAttrs(map[string]string{id: unquote(p.next())})
+		return nil
+	}
+	p.skipPort()
+
+	ids := []string{id}
+	for p.peek() == "->" || p.peek() == "--" {
+		p.pos++
+		next := p.peek()
+		if next == "" || strings.IndexByte("{}[];,=", next[0]) != -1 {
+			return fmt.Errorf("expected a node after %q", id)
+		}
+		ids = append(ids, unquote(p.next()))
+		p.skipPort()
+	}
+	attrs, err := p.attributes()
+	if err != nil {
+		return err
+	}
+
+	if len(ids) == 1 {
+		_, existed := p.g.byID[id]
+		n := p.g.node(id)
+		if !existed {
+			p.applyNodeAttrs(n, p.nodeAttrs)
+		}
+		p.applyNodeAttrs(n, attrs)
+		return nil
+	}
+	for i := 0; i+1 < len(ids); i++ {
+		for _, nid := range ids[i : i+2] {
+			if _, ok := p.g.byID[nid]; !ok {
+				p.applyNodeAttrs(p.g.node(nid), p.nodeAttrs)
+			}
+		}
+		e := p.g.addEdge(ids[i], ids[i+1], p.directed)
+		for _, a := range []map[string]string{p.edgeAttrs, attrs} {
+			if label, ok := a["label"]; ok {
+				e.label = label
+			}
+			switch a["style"] {
+			case "dashed", "dotted", "bold", "solid":
+				e.style = a["style"]
+			}
+			switch a["dir"] {
+			case "none":
+				e.directed = false
+			case "forward", "both", "back":
+				e.directed = true
+			}
+		}
+	}
+	return nil
+}
+
+// skipPort skips node ports like a:n or a:port:s, which aren't supported
+func (p *dotParser) skipPort() {
+	for p.peek() == ":" {
+		p.pos += 2
+	}
+}
+
+// attributes parses any number of [a=b, c=d] lists
+func (p *dotParser) attributes() (map[string]string, error) {
+	attrs := make(map[string]string)
+	for p.peek() == "[" {
+		p.pos++
+		for p.peek() != "]" {
+			if p.peek() == "" {
+				return nil, errors.New(`expected "]"`)
+			}
+			key := unquote(p.next())
+			if p.peek() == "=" {
+				p.pos++
+				attrs[key] = unquote(p.next())
+			} else {
+				attrs[key] = "true"
+			}
+			if p.peek() == "," || p.peek() == ";" {
+				p.pos++
+			}
+		}
+		p.pos++
+	}
+	return attrs, nil
+}
+
+func (p *dotParser) graphAttrs(attrs map[string]string) {
+	switch strings.ToUpper(attrs["rankdir"]) {
+	case "TB", "BT", "LR", "RL":
+		p.g.direction = strings.ToUpper(attrs["rankdir"])
+	}
+}
+
+func (p *dotParser) applyNodeAttrs(n *graphNode, attrs map[string]string) {
+	if label, ok := attrs["label"]; ok && label != `\N` {
+		n.label = label
+	}
+	switch attrs["shape"] {
+	case "box", "rect", "rectangle", "square", "record", "component", "box3d", "folder", "tab", "note":
+		n.shape = "box"
+	case "Mrecord":
+		n.shape = "rounded"
+	case "ellipse", "oval":
+		n.shape = "ellipse"
+	case "circle", "doublecircle", "point":
+		n.shape = "circle"
+	case "diamond", "Mdiamond":
+		n.shape = "diamond"
+	case "plaintext", "plain", "none", "underline":
+		n.shape = "plain"
+	}
+	if n.shape == "box" && strings.Contains(attrs["style"], "rounded") {
+		n.shape = "rounded"
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"flag"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+)
+
+var (
+	cspReportOnly = flag.Bool("csp-report-only", false, "send the Content-Security-Policy as report-only so violations are logged but not blocked")
+	cspReportURI  = flag.String("csp-report-uri", "/csp-report", "path that browsers send CSP violation reports to; empty disables reporting")
+)
+
+// placeholder in SecurityPolicy.CSP that's replaced by the request's nonce
+const NONCE_PLACEHOLDER = "{nonce}"
+
+// SecurityPolicy describes the security headers sent for a route
+type SecurityPolicy struct {
+	// Content-Security-Policy, not including frame-ancestors or reporting directives
+	CSP               string
+	FrameAncestors    string
+	ReferrerPolicy    string
+	PermissionsPolicy string
+}
+
+// policy for HTML pages; inline scripts and styles need the request's nonce
+var pagePolicy = SecurityPolicy{
+	CSP: "default-src 'self'; " +
+		"script-src 'self' 'nonce-" + NONCE_PLACEHOLDER + "'; " +
+		"style-src 'self' 'nonce-" + NONCE_PLACEHOLDER + "'; " +
+		"img-src 'self' data: https:; " +
+		"media-src 'self' https:; " +
+		"frame-src https:; " +
+		"object-src 'none'; base-uri 'self'; form-action 'self'",
+	FrameAncestors:    "'none'",
+	ReferrerPolicy:    "strict-origin-when-cross-origin",
+	PermissionsPolicy: "camera=(), microphone=(), geolocation=(), payment=(), usb=(), interest-cohort=()",
+}
+
+// policy for stylesheets, images and other files that never run scripts
+var assetPolicy = SecurityPolicy{
+	CSP:               "default-src 'none'; img-src 'self'; style-src 'self'",
+	FrameAncestors:    "'none'",
+	ReferrerPolicy:    "strict-origin-when-cross-origin",
+	PermissionsPolicy: pagePolicy.PermissionsPolicy,
+}
+
+type cspNonceKey struct{}
+
+// CSPNonce returns the nonce generated for this request, for use in the
+// nonce attribute of inline <script> and <style> elements
+func CSPNonce(r *http.Request) string {
+	nonce, _ := r.Context().Value(cspNonceKey{}).(string)
+	return nonce
+}
+
+func newNonce() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		// this should never happen, and a predictable nonce would defeat the point
+		panic("unable to generate CSP nonce: " + err.Error())
+	}
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// SecurityHeaders adds the headers described by p to every response from next
+func SecurityHeaders(p SecurityPolicy, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		h.Set("X-Content-Type-Options", "nosniff")
+		if len(p.ReferrerPolicy) > 0 {
+			h.Set("Referrer-Policy", p.ReferrerPolicy)
+		}
+		if len(p.PermissionsPolicy) > 0 {
+			h.Set("Permissions-Policy", p.PermissionsPolicy)
+		}
+		if p.FrameAncestors == "'none'" {
+			// for browsers that don't understand frame-ancestors
+			h.Set("X-Frame-Options", "DENY")
+		} else if p.FrameAncestors == "'self'" {
+			h.Set("X-Frame-Options", "SAMEORIGIN")
+		}
+
+		if len(p.CSP) > 0 {
+			csp := p.CSP
+			if strings.Contains(csp, NONCE_PLACEHOLDER) {
+				nonce := newNonce()
+				csp = strings.Replace(csp, NONCE_PLACEHOLDER, nonce, -1)
+				r = r.WithContext(context.WithValue(r.Context(), cspNonceKey{}, nonce))
+			}
+			if len(p.FrameAncestors) > 0 {
+				csp += "; frame-ancestors " + p.FrameAncestors
+			}
+			if len(*cspReportURI) > 0 {
+				csp += "; report-uri " + *cspReportURI + "; report-to csp-endpoint"
+				h.Set("Reporting-Endpoints", `csp-endpoint="`+*cspReportURI+`"`)
+			}
+			if *cspReportOnly {
+				h.Set("Content-Security-Policy-Report-Only", csp)
+			} else {
+				h.Set("Content-Security-Policy", csp)
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// CSPReportHandler logs the violation reports browsers send to the report URI
+func CSPReportHandler(w http.ResponseWriter, r *http.Request) {
+	// reports are small; don't let anyone fill up the logs
+	report, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 16*1024))
+	if err != nil {
+		w.WriteHeader(413)
+		return
+	}
+	log.Printf("CSP violation (%s) from %s: %s", r.Header.Get("Content-Type"), r.RemoteAddr, report)
+	w.WriteHeader(204)
+}
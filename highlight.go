@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"text/template"
+
+	"github.com/alecthomas/chroma"
+	"github.com/alecthomas/chroma/lexers"
+)
+
+// languageAliases maps fence languages people actually write onto the
+// lexer names they mean, for the ones chroma doesn't already know
+var languageAliases = map[string]string{
+	"asm":      "gas",
+	"assembly": "gas",
+	"arm":      "armasm",
+	"x86":      "nasm",
+	"terminal": "console",
+	"sv":       "systemverilog",
+	"vhd":      "vhdl",
+	"h":        "c",
+	"hpp":      "c++",
+	"cc":       "c++",
+	"cxx":      "c++",
+	"yml":      "yaml",
+	"make":     "makefile",
+	"txt":      "text",
+}
+
+// lexerFor finds the lexer for a fence language, or nil if there isn't one
+func lexerFor(lang string) chroma.Lexer {
+	lang = strings.ToLower(lang)
+	if alias, ok := languageAliases[lang]; ok {
+		lang = alias
+	}
+	lexer := lexers.Get(lang)
+	// plain text is better left to the escaped fallback
+	if lexer == nil || lexer.Config().Name == "plaintext" {
+		return nil
+	}
+	// merge runs of the same token type so the output isn't all spans
+	return chroma.Coalesce(lexer)
+}
+
+// tokenClass maps a chroma token type onto the gfmHTMLConfig class that
+// gfm.css already has styles for; an empty class means no span is needed
+func tokenClass(t chroma.TokenType) string {
+	switch {
+	case t == chroma.GenericInserted:
+		return "gi"
+	case t == chroma.GenericDeleted:
+		return "gd"
+	case t == chroma.KeywordType || t == chroma.NameClass || t == chroma.NameBuiltin:
+		return gfmHTMLConfig.Type
+	case t == chroma.CommentPreproc || t == chroma.CommentPreprocFile:
+		return gfmHTMLConfig.Keyword
+	case t == chroma.NameTag:
+		return gfmHTMLConfig.Tag
+	case t == chroma.NameAttribute:
+		return gfmHTMLConfig.HTMLAttrName
+	case t.InCategory(chroma.Keyword):
+		return gfmHTMLConfig.Keyword
+	case t.InCategory(chroma.Comment):
+		return gfmHTMLConfig.Comment
+	case t.InSubCategory(chroma.LiteralString):
+		return gfmHTMLConfig.String
+	case t.InSubCategory(chroma.LiteralNumber):
+		return gfmHTMLConfig.Decimal
+	case t.InCategory(chroma.Literal):
+		return gfmHTMLConfig.Literal
+	case t.InCategory(chroma.Operator), t.InCategory(chroma.Punctuation):
+		return gfmHTMLConfig.Punctuation
+	}
+	return ""
+}
+
+// highlightWithLexer highlights src using chroma's lexer for lang
+func highlightWithLexer(src []byte, lang string) ([]byte, bool) {
+	lexer := lexerFor(lang)
+	if lexer == nil {
+		return nil, false
+	}
+	it, err := lexer.Tokenise(nil, string(src))
+	if err != nil {
+		return nil, false
+	}
+
+	var buf bytes.Buffer
+	for _, tok := range it.Tokens() {
+		class := tokenClass(tok.Type)
+		if len(class) == 0 {
+			template.HTMLEscape(&buf, []byte(tok.Value))
+			continue
+		}
+		buf.WriteString(`<span class="` + class + `">`)
+		template.HTMLEscape(&buf, []byte(tok.Value))
+		buf.WriteString("</span>")
+	}
+	return buf.Bytes(), true
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+var templateDir = flag.String("templates", "templates", "directory holding the layouts/ and partials/ used to render pages")
+
+const DEFAULT_LAYOUT = "default"
+
+// Page is the data available to layouts
+type Page struct {
+	Title string
+	// front matter of the page's Markdown, if it has any
+	Meta FrontMatter
+	Host string
+	// URL path of the page
+	Path string
+	// nonce for inline <script> and <style> elements, see CSPNonce
+	Nonce   string
+	Content template.HTML
+	// name of the layout in templates/layouts, without the .html
+	Layout string
+	// neighbouring blog posts, if the page is one
+	Prev, Next *Post
+}
+
+var (
+	layoutsLock sync.RWMutex
+	layouts     map[string]*template.Template
+)
+
+// LoadLayouts parses every layout in templates/layouts along with all of
+// the partials in templates/partials, replacing the current set only if
+// they all parse
+func LoadLayouts() error {
+	partials, err := filepath.Glob(filepath.Join(*templateDir, "partials", "*.html"))
+	if err != nil {
+		return err
+	}
+	files, err := filepath.Glob(filepath.Join(*templateDir, "layouts", "*.html"))
+	if err != nil {
+		return err
+	}
+
+	loaded := make(map[string]*template.Template)
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), ".html")
+		t, err := template.ParseFiles(append([]string{file}, partials...)...)
+		if err != nil {
+			return err
+		}
+		loaded[name] = t
+	}
+	if _, ok := loaded[DEFAULT_LAYOUT]; !ok {
+		return fmt.Errorf("no %s layout in %s", DEFAULT_LAYOUT, *templateDir)
+	}
+
+	layoutsLock.Lock()
+	layouts = loaded
+	layoutsLock.Unlock()
+	return nil
+}
+
+// layoutForPath picks the layout for a page when the page doesn't choose
+// one itself: a layout named after the page's top level directory if there
+// is one, like layouts/projects.html for /projects/foo.md, or the default
+func layoutForPath(urlPath string) string {
+	dir := strings.SplitN(strings.TrimPrefix(urlPath, "/"), "/", 2)
+	if len(dir) == 2 {
+		layoutsLock.RLock()
+		_, ok := layouts[dir[0]]
+		layoutsLock.RUnlock()
+		if ok {
+			return dir[0]
+		}
+	}
+	return DEFAULT_LAYOUT
+}
+
+// renderPage fills in the request specific parts of page and writes it out
+// with the given status code using its layout
+func renderPage(w http.ResponseWriter, r *http.Request, code int, page Page) {
+	if DEBUG {
+		// pick up template edits without restarting
+		if err := LoadLayouts(); err != nil {
+			log.Printf("[ERR] unable to reload layouts: %v", err)
+		}
+	}
+
+	page.Host = r.Host
+	page.Path = r.URL.Path
+	page.Nonce = CSPNonce(r)
+	if len(page.Layout) == 0 {
+		page.Layout = layoutForPath(r.URL.Path)
+	}
+
+	layoutsLock.RLock()
+	t, ok := layouts[page.Layout]
+	if !ok {
+		log.Printf("[ERR] unknown layout %s for %s, using %s", page.Layout, r.URL.Path, DEFAULT_LAYOUT)
+		t = layouts[DEFAULT_LAYOUT]
+	}
+	layoutsLock.RUnlock()
+
+	// render into a buffer first so a broken template can still become a 500
+	var buf bytes.Buffer
+	if t == nil {
+		log.Printf("[ERR] layouts haven't been loaded")
+		w.WriteHeader(500)
+		w.Write([]byte("internal server error"))
+		return
+	}
+	if err := t.Execute(&buf, &page); err != nil {
+		log.Printf("[ERR] unable to render %s: %v", r.URL.Path, err)
+		w.WriteHeader(500)
+		w.Write([]byte("internal server error"))
+		return
+	}
+
+	body := buf.Bytes()
+	if *devMode {
+		body = injectReloadScript(body, page.Nonce)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(code)
+	w.Write(body)
+}
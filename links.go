@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/russross/blackfriday"
+	"golang.org/x/net/html"
+)
+
+// documentDir returns the directory, relative to static/, of a Markdown
+// file under static/; links and images in the file are relative to it
+func documentDir(file string) string {
+	dir := path.Dir(filepath.ToSlash(strings.TrimPrefix(file, STATIC_DIR+string(filepath.Separator))))
+	if dir == "." {
+		return ""
+	}
+	return dir
+}
+
+// resolveLink turns a link in a document in dir into the root relative
+// URL it points to, and reports whether it's a local link to something
+// that doesn't exist. Links with a scheme or host and links within the
+// page are returned unchanged.
+func resolveLink(dir, link string) (resolved string, broken bool) {
+	u, err := url.Parse(strings.TrimSpace(link))
+	if err != nil || len(u.Scheme) > 0 || len(u.Host) > 0 || len(u.Path) == 0 {
+		return link, false
+	}
+	// work on the escaped path so the link keeps its original escaping
+	escaped := strings.TrimSpace(link)
+	var rest string
+	if i := strings.IndexAny(escaped, "?#"); i != -1 {
+		escaped, rest = escaped[:i], escaped[i:]
+	}
+	p := escaped
+	if !strings.HasPrefix(p, "/") {
+		p = path.Join("/", dir, p)
+	} else {
+		p = path.Clean(p)
+	}
+	// keep the trailing slash on directories, which Clean drops
+	if strings.HasSuffix(escaped, "/") && p != "/" {
+		p += "/"
+	}
+	if p == "/intro.md" {
+		p = "/"
+	}
+	unescaped, err := url.PathUnescape(p)
+	if err != nil {
+		unescaped = p
+	}
+	return p + rest, !localPathExists(unescaped)
+}
+
+// localPathExists reports whether the server has something at urlPath,
+// either a file under static/ or one of the generated pages
+func localPathExists(urlPath string) bool {
+	switch urlPath {
+	case "/", "/atom.xml", "/rss.xml", "/feed.json", "/search", "/search.json", "/sitemap.xml", "/robots.txt", "/main.css":
+		return true
+	}
+	if len(*outboundPath) > 0 && urlPath == *outboundPath {
+		return true
+	}
+	if strings.HasPrefix(urlPath, "/gfm/") {
+		return true
+	}
+	// resized images exist whenever the original does
+	if strings.HasPrefix(urlPath, "/resize/") {
+		urlPath = strings.TrimPrefix(urlPath, "/resize")
+	}
+	if len(*blogDir) > 0 {
+		prefix := "/" + strings.Trim(*blogDir, "/") + "/"
+		if strings.HasPrefix(urlPath, prefix+"page/") || strings.HasPrefix(urlPath, prefix+"tags/") || urlPath == prefix+"tags" {
+			return true
+		}
+	}
+
+	file, err := resolvePath(STATIC_DIR, urlPath)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(file)
+	return err == nil
+}
+
+// linkOpen writes the start of a link, with relative links resolved
+// against the document's directory, links to missing local files marked
+// as broken, and links leaving the site given the -external-* attributes
+func (r *renderer) linkOpen(out *bytes.Buffer, link []byte, title []byte) {
+	dest, broken := resolveLink(r.path, string(link))
+	external := isExternalLink(dest)
+	if external && len(*outboundPath) > 0 {
+		dest = outboundURL(dest)
+	}
+	out.WriteString(`<a href="`)
+	attrEscape(out, []byte(dest))
+	if len(title) > 0 {
+		out.WriteString(`" title="`)
+		attrEscape(out, title)
+	}
+	if broken {
+		out.WriteString(`" class="broken-link`)
+	}
+	if external {
+		if len(*externalClass) > 0 {
+			out.WriteString(`" class="`)
+			attrEscape(out, []byte(*externalClass))
+		}
+		if len(*externalRel) > 0 {
+			out.WriteString(`" rel="`)
+			attrEscape(out, []byte(*externalRel))
+		}
+		if len(*externalTarget) > 0 {
+			out.WriteString(`" target="`)
+			attrEscape(out, []byte(*externalTarget))
+		}
+	}
+	out.WriteString(`">`)
+}
+
+func (r *renderer) Link(out *bytes.Buffer, link []byte, title []byte, content []byte) {
+	r.linkOpen(out, link, title)
+	out.Write(content)
+	out.WriteString("</a>")
+}
+
+func (r *renderer) AutoLink(out *bytes.Buffer, link []byte, kind int) {
+	if kind != blackfriday.LINK_TYPE_NORMAL {
+		r.Html.AutoLink(out, link, kind)
+		return
+	}
+	r.linkOpen(out, link, nil)
+	attrEscape(out, link)
+	out.WriteString("</a>")
+}
+
+// BrokenLink is a link on one page of the site to a file or anchor that
+// doesn't exist
+type BrokenLink struct {
+	File   string
+	Href   string
+	Reason string
+}
+
+// CheckLinks renders every page under static/ and returns the internal
+// links that point at missing files, missing anchors or drafts
+func CheckLinks() ([]BrokenLink, error) {
+	pages, err := sitePages()
+	if err != nil {
+		return nil, err
+	}
+
+	type pageLinks struct {
+		page  SitePage
+		hrefs []string
+	}
+	anchors := make(map[string]map[string]bool)
+	drafts := make(map[string]bool)
+	var rendered []pageLinks
+	for _, page := range pages {
+		b := renderMarkdown(page.Body, documentDir(page.File), markdownOptions{toc: page.Meta.TOC})
+		doc, err := html.Parse(bytes.NewReader(b))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", page.File, err)
+		}
+
+		names := make(map[string]bool)
+		var hrefs []string
+		var walk func(*html.Node)
+		walk = func(n *html.Node) {
+			if n.Type == html.ElementNode {
+				for _, attr := range n.Attr {
+					switch {
+					case attr.Key == "id", attr.Key == "name" && n.Data == "a":
+						names[attr.Val] = true
+					case attr.Key == "href" && n.Data == "a":
+						hrefs = append(hrefs, attr.Val)
+					}
+				}
+			}
+			for c := n.FirstChild; c != nil; c = c.NextSibling {
+				walk(c)
+			}
+		}
+		walk(doc)
+
+		urlPath := "/" + filepath.ToSlash(strings.TrimPrefix(page.File, STATIC_DIR+string(filepath.Separator)))
+		anchors[urlPath] = names
+		if page.Path != urlPath {
+			anchors[page.Path] = names
+		}
+		if page.Meta.Draft {
+			drafts[urlPath] = true
+			drafts[page.Path] = true
+		}
+		rendered = append(rendered, pageLinks{page, hrefs})
+	}
+
+	var broken []BrokenLink
+	for _, p := range rendered {
+		for _, href := range p.hrefs {
+			u, err := url.Parse(href)
+			if err != nil {
+				broken = append(broken, BrokenLink{p.page.File, href, "unparseable URL"})
+				continue
+			}
+			if len(u.Scheme) > 0 || len(u.Host) > 0 {
+				continue
+			}
+			target := u.Path
+			if len(target) == 0 {
+				target = p.page.Path
+			} else if !localPathExists(target) {
+				broken = append(broken, BrokenLink{p.page.File, href, "no such file"})
+				continue
+			}
+			if drafts[target] && !p.page.Meta.Draft {
+				broken = append(broken, BrokenLink{p.page.File, href, "page is a draft"})
+				continue
+			}
+			if names, ok := anchors[target]; ok && len(u.Fragment) > 0 && !names[u.Fragment] {
+				broken = append(broken, BrokenLink{p.page.File, href, "no such anchor"})
+			}
+		}
+	}
+	return broken, nil
+}
+
+// checkLinksCommand implements "main-server check-links", printing every
+// broken link and returning the exit status
+func checkLinksCommand(out io.Writer) int {
+	broken, err := CheckLinks()
+	if err != nil {
+		fmt.Fprintf(out, "unable to check links: %v\n", err)
+		return 2
+	}
+	for _, b := range broken {
+		fmt.Fprintf(out, "%s: %s: %s\n", b.File, b.Href, b.Reason)
+	}
+	if len(broken) > 0 {
+		fmt.Fprintf(out, "%d broken links\n", len(broken))
+		return 1
+	}
+	return 0
+}
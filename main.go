@@ -8,6 +8,7 @@ import (
 	"encoding/hex"
 	"flag"
 	"fmt"
+	"html/template"
 	"log"
 	"net/http"
 	"net/http/httputil"
@@ -16,6 +17,7 @@ import (
 	"os/exec"
 	"os/signal"
 	"strings"
+	"time"
 
 	"io/ioutil"
 
@@ -27,97 +29,133 @@ const DEBUG = false
 
 const DOMAIN_NAME = "threefortiethofonehamster.com"
 
-const HTML_HEADER = `<!doctype html5>
-<html>
-<head>
-  <meta charset=utf-8>
-	<meta name="viewport" content="width=device-width, initial-scale=1">
-	<title>%s | %s</title>
-	<link href=/gfm/gfm.css media=all rel=stylesheet type=text/css></link>
-	<link href=/main.css media=all rel=stylesheet type=text/css></link>
-</head>
-<body>
-<nav>
-<div class="nav-wrapper">
-	<div class="nav-item"><a href="/">Home</a></div>
-	<div class="nav-item"><a href="/builds.md">Projects</a></div>
-	<div class="nav-item"><a href="https://git.threefortiethofonehamster.com/">Code</a></div>
-	<div class="nav-item"><a href="/resume/resume-KelvinLy-hardware.pdf">Resume</a></div>
-</div>
-</nav>
-<article class="markdown-body entry-content" style="padding:4em;">
-`
-
-const HTML_FOOTER = `
-</article>
-<footer>
-<div class="footer-wrapper">
-by Kelvin Ly, source available <a href="https://github.com/cactorium/threefortiethofonehamster.com">here</a>
-</div>
-</footer>
-</body>
-</html>`
-
 func serveMarkdown(w http.ResponseWriter, r *http.Request, paths ...string) {
-	bs := make([][]byte, 0, len(paths))
-	for _, path := range paths {
-		if b, err := ioutil.ReadFile(path); err != nil {
-			w.WriteHeader(404)
-			w.Write([]byte(fmt.Sprintf("file %s not found", path)))
+	stamps, err := stampFiles(paths)
+	if err != nil {
+		serveError(w, r, 404, "")
+		return
+	}
+	key := strings.Join(paths, "\x00")
+	rendered, ok := renders.Get(key, stamps)
+	if !ok {
+		rendered, err = renderMarkdownFiles(paths)
+		if _, unreadable := err.(*os.PathError); unreadable {
+			serveError(w, r, 404, "")
+			return
+		} else if err != nil {
+			log.Printf("[ERR] unable to render %s: %v", r.URL.Path, err)
+			serveError(w, r, 500, "")
 			return
-		} else {
-			bs = append(bs, b)
 		}
+		rendered.stamps = stamps
+		renders.Put(key, rendered)
+	}
+	if rendered.meta.Draft && !DEBUG {
+		serveError(w, r, 404, "")
+		return
+	}
+
+	page := Page{
+		Title:   rendered.title,
+		Meta:    rendered.meta,
+		Content: rendered.content,
+		Layout:  rendered.meta.Layout,
+	}
+	if isBlogPost(r.URL.Path) {
+		page.Prev, page.Next = blog.Neighbours(r.URL.Path)
 	}
-	w.Header().Add("Content-Type", "text/html; charset=utf-8")
-	title := ""
-	if s := bytes.Index(bs[0], []byte("# ")); s != -1 {
-		t := bs[0][s+2:]
-		if e := bytes.Index(t, []byte("\n")); e != -1 {
-			t = t[:e]
-			title = string(t)
+	renderPage(w, r, 200, page)
+}
+
+// renderMarkdownFiles renders Markdown files into the content of one page
+func renderMarkdownFiles(paths []string) (renderedPage, error) {
+	bs := make([][]byte, 0, len(paths))
+	var meta FrontMatter
+	for i, path := range paths {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return renderedPage{}, err
 		}
+		m, body, err := ParseFrontMatter(b)
+		if err != nil {
+			return renderedPage{}, fmt.Errorf("%s: %v", path, err)
+		}
+		// the first file decides the page's metadata
+		if i == 0 {
+			meta = m
+		}
+		bs = append(bs, body)
 	}
-	w.Write([]byte(fmt.Sprintf(HTML_HEADER, string(title), r.Host)))
+
+	var content bytes.Buffer
+	// all of the files end up on one page, so they share heading anchors
+	anchors := make(map[string]bool)
 	for i, b := range bs {
-		pathDir := paths[i][len("static/"):]
-		lastSlash := strings.LastIndex(pathDir, "/")
-		if lastSlash != -1 {
-			pathDir = pathDir[:lastSlash]
-		}
-		// Markdown uses the path to generate the correct paths for resized images
-		html := Markdown(b, pathDir)
-		w.Write(html)
+		// Markdown uses the directory to resolve relative links and images
+		html := renderMarkdown(b, documentDir(paths[i]), markdownOptions{toc: i == 0 && meta.TOC, anchors: anchors})
+		content.Write(html)
 	}
-	w.Write([]byte(HTML_FOOTER))
+
+	title := meta.Title
+	if len(title) == 0 {
+		title = markdownTitle(bs[0])
+	}
+	return renderedPage{meta: meta, title: title, content: template.HTML(content.String())}, nil
 }
 
+// rootHandler serves GET and HEAD requests for pages and files under static/;
+// the server relies on net/http to drop the body for HEAD
 func rootHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method == "GET" {
-		if r.URL.Path == "/" {
-			serveMarkdown(w, r, "static/intro.md")
-		} else if strings.HasSuffix(r.URL.Path, ".md") {
-			if strings.Contains(r.URL.Path, "..") {
-				w.WriteHeader(403)
-				w.Write([]byte("\"..\" forbidden in URL"))
-				return
-			}
-			filepath := "static" + r.URL.Path
-			serveMarkdown(w, r, filepath)
-		} else {
-			http.ServeFile(w, r, "static"+r.URL.Path)
-		}
+	if r.URL.Path == "/" {
+		serveMarkdown(w, r, STATIC_DIR+"/intro.md")
+		return
+	}
+
+	filepath, err := resolvePath(STATIC_DIR, r.URL.Path)
+	if err == errHiddenPath {
+		serveError(w, r, 404, "")
+		return
+	} else if err != nil {
+		serveError(w, r, 403, "")
+		return
+	}
+	if _, err := os.Stat(filepath); err != nil {
+		serveError(w, r, 404, "")
+		return
+	}
+
+	if strings.HasSuffix(r.URL.Path, ".md") {
+		serveMarkdown(w, r, filepath)
 	} else {
-		w.Write([]byte("unimplemented!"))
+		staticServer.ServeHTTP(w, r)
 	}
 }
 
 var (
 	serverShutdown chan struct{} = make(chan struct{})
+	staticServer                 = http.FileServer(staticFS)
 )
 
 func main() {
 	flag.Parse()
+	if *markdownEngine != "commonmark" && *markdownEngine != "blackfriday" {
+		log.Fatalf("unknown Markdown engine %q", *markdownEngine)
+	}
+	if flag.Arg(0) == "check-links" {
+		os.Exit(checkLinksCommand(os.Stdout))
+	}
+	if err := LoadLayouts(); err != nil {
+		log.Fatalf("unable to load layouts: %v", err)
+	}
+	searchIndex.Rebuild()
+	if *devMode {
+		if err := WatchSite(); err != nil {
+			log.Fatalf("unable to watch for changes: %v", err)
+		}
+	}
+	if err := checkRedirectCode(*redirectCode); err != nil {
+		log.Fatal(err)
+	}
 
 	var redirect http.Server
 	var srv http.Server
@@ -140,6 +178,22 @@ func main() {
 	log.Println("server terminated")
 }
 
+// contentUpdated throws away everything generated from static/ after the
+// webhook pulls in new content
+func contentUpdated() {
+	blog.Invalidate()
+	generated.Invalidate()
+	renders.Invalidate()
+	resized.Invalidate()
+	if *devMode {
+		// re-rendering the whole site on every save is wasted while
+		// writing, so leave it to the next search
+		searchIndex.Invalidate()
+	} else {
+		go searchIndex.Rebuild()
+	}
+}
+
 func readWebhookKey() []byte {
 	b, err := ioutil.ReadFile("webhook_secret")
 	if err != nil {
@@ -170,39 +224,58 @@ func startServer(srv *http.Server) {
 		log.Fatalf("unable to parse reverse proxy path: %v", err)
 		return
 	}
-	serveMux.Handle("dev."+DOMAIN_NAME+"/", httputil.NewSingleHostReverseProxy(url))
+	devProxy := httputil.NewSingleHostReverseProxy(url)
+	devProxy.ErrorHandler = proxyErrorHandler
+	serveMux.Handle("dev."+DOMAIN_NAME+"/", devProxy)
 
 	gogsUrl, err := url.Parse("http://localhost:7000")
 	if err != nil {
 		log.Fatalf("unable to parse reverse proxy path: %v", err)
 		return
 	}
-	serveMux.Handle("git."+DOMAIN_NAME+"/", httputil.NewSingleHostReverseProxy(gogsUrl))
-
-	serveMux.HandleFunc("/", rootHandler)
+	gogsProxy := httputil.NewSingleHostReverseProxy(gogsUrl)
+	gogsProxy.ErrorHandler = proxyErrorHandler
+	serveMux.Handle("git."+DOMAIN_NAME+"/", gogsProxy)
+
+	serveMux.Handle("/", SecurityHeaders(pagePolicy, Methods(http.HandlerFunc(rootHandler), "GET")))
+	if len(*blogDir) > 0 {
+		blogPrefix := "/" + strings.Trim(*blogDir, "/") + "/"
+		serveMux.Handle(blogPrefix, SecurityHeaders(pagePolicy, Methods(BlogHandler(http.HandlerFunc(rootHandler)), "GET")))
+	}
+	serveMux.Handle("/atom.xml", SecurityHeaders(assetPolicy, Methods(generated.Handler("application/atom+xml; charset=utf-8", func() ([]byte, error) { return AtomFeed(feedPosts()) }), "GET")))
+	serveMux.Handle("/rss.xml", SecurityHeaders(assetPolicy, Methods(generated.Handler("application/rss+xml; charset=utf-8", func() ([]byte, error) { return RSSFeed(feedPosts()) }), "GET")))
+	serveMux.Handle("/feed.json", SecurityHeaders(assetPolicy, Methods(generated.Handler("application/feed+json; charset=utf-8", func() ([]byte, error) { return JSONFeed(feedPosts()) }), "GET")))
+	serveMux.Handle("/search", SecurityHeaders(pagePolicy, Methods(http.HandlerFunc(SearchHandler), "GET")))
+	serveMux.Handle("/search.json", SecurityHeaders(assetPolicy, Methods(http.HandlerFunc(SearchHandler), "GET")))
+	serveMux.Handle("/sitemap.xml", SecurityHeaders(assetPolicy, Methods(generated.Handler("application/xml; charset=utf-8", Sitemap), "GET")))
+	serveMux.Handle("/robots.txt", SecurityHeaders(assetPolicy, Methods(generated.Handler("text/plain; charset=utf-8", Robots), "GET")))
 	//serveMux.Handle("/certbot/", http.StripPrefix("/certbot/", http.FileServer(http.Dir("./certbot-tmp"))))
-	serveMux.Handle("/gfm/", http.StripPrefix("/gfm", http.FileServer(gfmstyle.Assets)))
-	serveMux.Handle("/resize/", Cache(Resize(640, http.StripPrefix("/resize", http.FileServer(http.Dir("static/"))))))
-	serveMux.HandleFunc("/main.css", func(w http.ResponseWriter, r *http.Request) { http.ServeFile(w, r, "main.css") })
+	serveMux.Handle("/gfm/", SecurityHeaders(assetPolicy, Methods(http.StripPrefix("/gfm", http.FileServer(gfmstyle.Assets)), "GET")))
+	serveMux.Handle("/resize/", SecurityHeaders(assetPolicy, Methods(resized.Handler(Resize(640, http.StripPrefix("/resize", http.FileServer(staticFS)))), "GET")))
+	serveMux.Handle("/main.css", SecurityHeaders(assetPolicy, Methods(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { http.ServeFile(w, r, "main.css") }), "GET")))
+	if *devMode {
+		serveMux.Handle(DEV_RELOAD_PATH, SecurityHeaders(assetPolicy, Methods(http.HandlerFunc(ReloadHandler), "GET")))
+		// open event streams would otherwise hold up Shutdown forever
+		srv.RegisterOnShutdown(reloads.Close)
+	}
+	if len(*outboundPath) > 0 {
+		serveMux.Handle(*outboundPath, SecurityHeaders(pagePolicy, Methods(http.HandlerFunc(OutboundHandler), "GET")))
+	}
+	if len(*cspReportURI) > 0 {
+		serveMux.Handle(*cspReportURI, Methods(http.HandlerFunc(CSPReportHandler), "POST"))
+	}
 	if webhookKey != nil {
 		log.Print("web hook found")
-		serveMux.HandleFunc("/update", func(w http.ResponseWriter, r *http.Request) {
-			if r.Method != "POST" {
-				w.WriteHeader(403)
-				w.Write([]byte("invalid request type"))
-				return
-			}
+		serveMux.Handle("/update", Methods(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			signature := r.Header.Get("X-Hub-Signature")
-			if len(signature) == 0 {
-				w.WriteHeader(403)
-				w.Write([]byte("invalid request"))
+			if len(signature) < len("sha1=") {
+				serveError(w, r, 403, "missing signature")
 				return
 			}
 
 			payload, e := ioutil.ReadAll(r.Body)
 			if e != nil {
-				w.WriteHeader(403)
-				w.Write([]byte("unable to read body: " + e.Error()))
+				serveError(w, r, 403, "unable to read body: "+e.Error())
 				return
 			}
 
@@ -214,16 +287,14 @@ func startServer(srv *http.Server) {
 			// skip the "sha1=" part
 			sdl, e2 := hex.Decode(signatureDec, []byte(signature)[5:])
 			if e2 != nil {
-				w.WriteHeader(403)
-				w.Write([]byte("unable to read signature"))
+				serveError(w, r, 403, "unable to read signature")
 				return
 			}
 
 			signatureDec = signatureDec[:sdl]
 			if !hmac.Equal(expected, signatureDec) {
-				log.Print("webhook hmac match failed; expected %v found %v", expected, signatureDec)
-				w.WriteHeader(403)
-				w.Write([]byte("invalid request"))
+				log.Printf("webhook hmac match failed; expected %v found %v", expected, signatureDec)
+				serveError(w, r, 403, "signature mismatch")
 				return
 			}
 			// TODO parse payload
@@ -236,16 +307,31 @@ func startServer(srv *http.Server) {
 			updateCmd.Dir = "./static/"
 			_ = updateCmd.Run()
 
+			contentUpdated()
+
 			w.Write([]byte("success"))
-		})
+		}), "POST"))
 	}
 
 	srv.Addr = ":8443"
-	srv.Handler = Gzip(serveMux)
+	srv.Handler = Gzip(HSTS(serveMux))
 	log.Print("starting server at " + srv.Addr)
 	if !DEBUG {
-		log.Fatal(srv.ListenAndServeTLS("/etc/letsencrypt/live/"+DOMAIN_NAME+"/fullchain.pem",
-			"/etc/letsencrypt/live/"+DOMAIN_NAME+"/privkey.pem"))
+		certs, err := NewCertStore(CERT_FILE, KEY_FILE)
+		if err != nil {
+			log.Fatalf("unable to load certificate: %v", err)
+			return
+		}
+		// pick up certbot renewals and fresh OCSP responses
+		go certs.Refresh(12 * time.Hour)
+
+		tlsConfig, err := TLSConfig(certs)
+		if err != nil {
+			log.Fatalf("invalid TLS configuration: %v", err)
+			return
+		}
+		srv.TLSConfig = tlsConfig
+		log.Fatal(srv.ListenAndServeTLS("", ""))
 	} else {
 		log.Fatal(srv.ListenAndServe())
 	}
@@ -260,14 +346,16 @@ func startRedirectServer(srv *http.Server) {
 		log.Fatalf("unable to parse reverse proxy path: %v", err)
 		return
 	}
-	serveMux.Handle("dev."+DOMAIN_NAME+"/", httputil.NewSingleHostReverseProxy(url))
+	devProxy := httputil.NewSingleHostReverseProxy(url)
+	devProxy.ErrorHandler = proxyErrorHandler
+	serveMux.Handle("dev."+DOMAIN_NAME+"/", devProxy)
 
 	serveMux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
 		target := "https://" + req.Host + req.URL.Path
 		if len(req.URL.RawQuery) > 0 {
 			target += "?" + req.URL.RawQuery
 		}
-		http.Redirect(w, req, target, http.StatusTemporaryRedirect)
+		http.Redirect(w, req, target, *redirectCode)
 	})
 
 	srv.Addr = ":8080"
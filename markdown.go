@@ -14,9 +14,11 @@ package main
 
 import (
 	"bytes"
+	"flag"
 	"fmt"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"text/template"
 
@@ -30,15 +32,76 @@ import (
 	"golang.org/x/net/html"
 )
 
+var markdownEngine = flag.String("markdown-engine", "commonmark", "Markdown parser: commonmark, or blackfriday for the old GitHub Flavored Markdown fork")
+
+var sanitizeDirs = flag.String("sanitize-dirs", "", "comma separated list of directories under static/ whose Markdown is sanitized, e.g. ones pulled in from other people's submodules")
+
 // Markdown renders GitHub Flavored Markdown text.
 func Markdown(text []byte, path string) []byte {
+	return renderMarkdown(text, path, markdownOptions{})
+}
+
+// markdownOptions are per document rendering settings, usually from front matter
+type markdownOptions struct {
+	// insert a table of contents even without a [TOC] marker
+	toc bool
+	// anchor names already used on the page; set this when several
+	// documents are rendered into one page so their anchors don't collide
+	anchors map[string]bool
+}
+
+func renderMarkdown(text []byte, path string, opts markdownOptions) []byte {
 	const htmlFlags = 0
+	anchors := opts.anchors
+	if anchors == nil {
+		anchors = make(map[string]bool)
+	}
 	renderer := &renderer{
-		Html: blackfriday.HtmlRenderer(htmlFlags, "", "").(*blackfriday.Html), path: path}
-	unsanitized := blackfriday.Markdown(text, renderer, extensions)
+		Html:    blackfriday.HtmlRenderer(htmlFlags, "", "").(*blackfriday.Html),
+		path:    path,
+		anchors: anchors,
+	}
+	// footnote ids have to be unique across the documents on a page too, so
+	// the first document with footnotes uses fn:1, the next 1-fn:1 and so on
+	if bytes.Contains(text, []byte("[^")) {
+		n := 0
+		for anchors[footnotePrefix(n)+"fn:"] {
+			n++
+		}
+		renderer.footnotePrefix = footnotePrefix(n)
+		anchors[renderer.footnotePrefix+"fn:"] = true
+	}
+	text, math := extractMath(text)
+	var unsanitized []byte
+	if *markdownEngine == "blackfriday" {
+		unsanitized = blackfriday.Markdown(text, renderer, extensions)
+	} else {
+		unsanitized = renderCommonMark(text, renderer)
+	}
+	unsanitized = insertTOC(unsanitized, renderer.headings, opts.toc)
+	unsanitized = restoreMath(unsanitized, math)
+	if shouldSanitize(path) {
+		return sanitize(unsanitized)
+	}
 	return unsanitized
 }
 
+// shouldSanitize reports whether documents in the directory path (relative to static/)
+// fall under one of the directories listed in -sanitize-dirs
+func shouldSanitize(path string) bool {
+	path = strings.Trim(path, "/")
+	for _, dir := range strings.Split(*sanitizeDirs, ",") {
+		dir = strings.Trim(strings.TrimSpace(dir), "/")
+		if len(dir) == 0 {
+			continue
+		}
+		if path == dir || strings.HasPrefix(path, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
 // extensions for GitHub Flavored Markdown-like parsing.
 const extensions = blackfriday.EXTENSION_NO_INTRA_EMPHASIS |
 	blackfriday.EXTENSION_TABLES |
@@ -46,28 +109,188 @@ const extensions = blackfriday.EXTENSION_NO_INTRA_EMPHASIS |
 	blackfriday.EXTENSION_AUTOLINK |
 	blackfriday.EXTENSION_STRIKETHROUGH |
 	blackfriday.EXTENSION_SPACE_HEADERS |
-	blackfriday.EXTENSION_NO_EMPTY_LINE_BEFORE_BLOCK
+	blackfriday.EXTENSION_NO_EMPTY_LINE_BEFORE_BLOCK |
+	blackfriday.EXTENSION_FOOTNOTES |
+	blackfriday.EXTENSION_DEFINITION_LISTS
 
 // policy for GitHub Flavored Markdown-like sanitization.
 var policy = func() *bluemonday.Policy {
 	p := bluemonday.UGCPolicy()
-	p.AllowAttrs("class").Matching(bluemonday.SpaceSeparatedTokens).OnElements("div", "span")
+	p.AllowAttrs("class").Matching(bluemonday.SpaceSeparatedTokens).OnElements("div", "span", "p", "sup")
 	p.AllowAttrs("class", "name").Matching(bluemonday.SpaceSeparatedTokens).OnElements("a")
-	p.AllowAttrs("rel").Matching(regexp.MustCompile(`^nofollow$`)).OnElements("a")
+	p.AllowAttrs("rel").Matching(regexp.MustCompile(`^(?:nofollow|noopener|noreferrer|external|ugc)(?: (?:nofollow|noopener|noreferrer|external|ugc))*$`)).OnElements("a")
+	p.AllowAttrs("target").Matching(regexp.MustCompile(`^_(?:blank|self|parent|top)$`)).OnElements("a")
 	p.AllowAttrs("aria-hidden").Matching(regexp.MustCompile(`^true$`)).OnElements("a")
+	// footnotes
+	p.AllowAttrs("role").Matching(regexp.MustCompile(`^doc-(?:noteref|backlink)$`)).OnElements("a")
+	p.AllowAttrs("role").Matching(regexp.MustCompile(`^doc-endnotes$`)).OnElements("div")
 	p.AllowAttrs("type").Matching(regexp.MustCompile(`^checkbox$`)).OnElements("input")
 	p.AllowAttrs("checked", "disabled").Matching(regexp.MustCompile(`^$`)).OnElements("input")
 	p.AllowDataURIImages()
+	// responsive images generated by renderer.Image
+	p.AllowElements("picture")
+	p.AllowAttrs("srcset").Matching(srcsetPattern).OnElements("source", "img")
+	// tables of contents
+	p.AllowElements("nav")
+	p.AllowAttrs("class").Matching(bluemonday.SpaceSeparatedTokens).OnElements("nav")
+	p.AllowAttrs("media").Matching(regexp.MustCompile(`^[a-zA-Z0-9 ():,.\-]*$`)).OnElements("source")
+	// captioned code blocks
+	p.AllowElements("figure", "figcaption")
+	p.AllowAttrs("class").Matching(bluemonday.SpaceSeparatedTokens).OnElements("figure", "figcaption")
+	// MathML from TeXToMathML
+	p.AllowNoAttrs().OnElements("math", "semantics", "annotation", "mrow", "mi", "mn", "mo", "mtext",
+		"mspace", "mfrac", "msqrt", "mroot", "msub", "msup", "msubsup", "munder", "mover",
+		"munderover", "mtable", "mtr", "mtd", "mstyle", "merror")
+	p.AllowAttrs("display", "mathvariant", "movablelimits", "accent", "accentunder", "stretchy",
+		"fence", "linethickness", "displaystyle", "columnalign", "columnspacing", "width", "encoding").
+		Matching(regexp.MustCompile(`^[a-zA-Z0-9.\-/ ]*$`)).OnElements("math", "mi", "mo", "mover",
+		"munder", "mfrac", "mstyle", "mtable", "mspace", "annotation")
+	p.AllowAttrs("class").Matching(bluemonday.SpaceSeparatedTokens).OnElements("code")
+	// SVG diagrams from writeDiagram, without anything that can load or run things
+	p.AllowNoAttrs().OnElements(svgElements...)
+	p.AllowAttrs("viewbox", "width", "height", "role", "class",
+		"x", "y", "x1", "y1", "x2", "y2", "cx", "cy", "r", "rx", "ry", "points", "d",
+		"fill-opacity", "stroke-width", "stroke-dasharray", "stroke-opacity",
+		"refx", "refy", "markerwidth", "markerheight", "orient",
+		"text-anchor", "dominant-baseline", "font-family", "font-size", "font-weight", "font-style").
+		Matching(regexp.MustCompile(`^[a-zA-Z0-9 #.,\-%_]*$`)).OnElements(svgElements...)
+	p.AllowAttrs("xmlns").Matching(regexp.MustCompile(`^http://www\.w3\.org/2000/svg$`)).OnElements("svg")
+	p.AllowAttrs("transform").Matching(regexp.MustCompile(`^(?:\s*(?:matrix|translate|scale|rotate|skewX|skewY)\([0-9eE.,\- ]*\))*\s*$`)).OnElements(svgElements...)
+	// paint can only refer to the diagram's own markers, not to anything
+	// outside the page; sanitize drops any other ids
+	p.AllowAttrs("fill", "stroke", "marker-end", "marker-start").
+		Matching(regexp.MustCompile(`^(?:#[0-9a-fA-F]{3,8}|[a-zA-Z]+|url\(#diagram-[a-zA-Z0-9\-]+\))$`)).OnElements(svgElements...)
 	return p
 }()
 
+var svgElements = []string{"svg", "defs", "marker", "g", "title", "rect", "ellipse", "circle",
+	"polygon", "polyline", "path", "line", "text", "tspan"}
+
+// svgID matches the ids diagramID makes and the ones drawGraph derives from them
+var svgID = regexp.MustCompile(`^diagram-[a-zA-Z0-9\-]+$`)
+
+// sanitize runs b through policy. The policy allows ids on every element,
+// so ids on SVG elements that didn't come from diagramID are dropped after.
+func sanitize(b []byte) []byte {
+	b = policy.SanitizeBytes(b)
+	if !bytes.Contains(b, []byte("<svg")) {
+		return b
+	}
+	isSVG := make(map[string]bool)
+	for _, e := range svgElements {
+		isSVG[e] = true
+	}
+	var out bytes.Buffer
+	z := html.NewTokenizer(bytes.NewReader(b))
+	for z.Next() != html.ErrorToken {
+		raw := append([]byte(nil), z.Raw()...)
+		tok := z.Token()
+		if (tok.Type != html.StartTagToken && tok.Type != html.SelfClosingTagToken) || !isSVG[tok.Data] {
+			out.Write(raw)
+			continue
+		}
+		attrs := tok.Attr[:0]
+		for _, a := range tok.Attr {
+			if a.Key != "id" || svgID.MatchString(a.Val) {
+				attrs = append(attrs, a)
+			}
+		}
+		tok.Attr = attrs
+		out.WriteString(tok.String())
+	}
+	return out.Bytes()
+}
+
+// bluemonday doesn't check srcset URLs, so only allow relative paths and http(s) links
+var srcsetPattern = func() *regexp.Regexp {
+	const candidate = `(?:https?://[^\s,]+|[^\s,:]+)(?:\s+[0-9.]+[wx])?`
+	return regexp.MustCompile(`^\s*` + candidate + `(?:\s*,\s*` + candidate + `)*\s*$`)
+}()
+
 type renderer struct {
 	*blackfriday.Html
 	path string
+
+	// every heading in the document, for the table of contents
+	headings []heading
+	// anchor names already used in the document
+	anchors map[string]bool
+
+	// prepended to footnote ids, see footnotePrefix
+	footnotePrefix string
+	// number of references to each footnote so far, and footnotes written
+	footnoteRefs  map[int]int
+	footnoteItems int
+}
+
+// footnotePrefix returns the footnote id prefix for the nth document with
+// footnotes on a page
+func footnotePrefix(n int) string {
+	if n == 0 {
+		return ""
+	}
+	return strconv.Itoa(n) + "-"
+}
+
+// the footnote markup is goldmark's, so both engines can share styles
+const footnoteBacklink = "&#x21a9;&#xfe0e;"
+
+func (r *renderer) FootnoteRef(out *bytes.Buffer, ref []byte, id int) {
+	if r.footnoteRefs == nil {
+		r.footnoteRefs = make(map[int]int)
+	}
+	refIndex := r.footnoteRefs[id]
+	r.footnoteRefs[id]++
+	fmt.Fprintf(out, `<sup id="%s"><a href="#%sfn:%d" class="footnote-ref" role="doc-noteref">%d</a></sup>`, footnoteRefID(r.footnotePrefix, refIndex, id), r.footnotePrefix, id, id)
+}
+
+// footnoteRefID returns the id of a reference to footnote id; the first
+// reference is fnref:N, later ones fnref1:N, fnref2:N and so on
+func footnoteRefID(prefix string, refIndex, id int) string {
+	if refIndex == 0 {
+		return fmt.Sprintf("%sfnref:%d", prefix, id)
+	}
+	return fmt.Sprintf("%sfnref%d:%d", prefix, refIndex, id)
+}
+
+func (r *renderer) Footnotes(out *bytes.Buffer, text func() bool) {
+	out.WriteString("<div class=\"footnotes\" role=\"doc-endnotes\">\n<hr />\n<ol>\n")
+	text()
+	out.WriteString("</ol>\n</div>\n")
+}
+
+func (r *renderer) FootnoteItem(out *bytes.Buffer, name, text []byte, flags int) {
+	r.footnoteItems++
+	id := r.footnoteItems
+	text = bytes.TrimSpace(text)
+	if !bytes.HasPrefix(text, []byte("<p>")) {
+		// single line footnotes don't get a paragraph from blackfriday
+		text = append(append([]byte("<p>"), text...), "</p>"...)
+	}
+	var backlinks bytes.Buffer
+	for i := 0; i < r.footnoteRefs[id] || i == 0; i++ {
+		fmt.Fprintf(&backlinks, `&#160;<a href="#%s" class="footnote-backref" role="doc-backlink">%s</a>`, footnoteRefID(r.footnotePrefix, i, id), footnoteBacklink)
+	}
+	fmt.Fprintf(out, "<li id=\"%sfn:%d\">\n", r.footnotePrefix, id)
+	if bytes.HasSuffix(text, []byte("</p>")) {
+		out.Write(text[:len(text)-len("</p>")])
+		out.Write(backlinks.Bytes())
+		out.WriteString("</p>")
+	} else {
+		out.Write(text)
+		out.Write(backlinks.Bytes())
+	}
+	out.WriteString("\n</li>\n")
+}
+
+type heading struct {
+	level  int
+	anchor string
+	text   string
 }
 
 // GitHub Flavored Markdown heading with clickable and hidden anchor.
-func (*renderer) Header(out *bytes.Buffer, text func() bool, level int, _ string) {
+func (r *renderer) Header(out *bytes.Buffer, text func() bool, level int, _ string) {
 	marker := out.Len()
 	doubleSpace(out)
 
@@ -87,20 +310,114 @@ func (*renderer) Header(out *bytes.Buffer, text func() bool, level int, _ string
 		// Failed to parse HTML (probably can never happen), so just use the whole thing.
 		textContent = html.UnescapeString(textHTML)
 	}
-	anchorName := sanitized_anchor_name.Create(textContent)
+	// math is still a placeholder here, and shouldn't end up in the anchor
+	anchorName := r.uniqueAnchor(sanitized_anchor_name.Create(mathPlaceholder.ReplaceAllString(textContent, "")))
+	r.headings = append(r.headings, heading{level, anchorName, textContent})
 
 	out.WriteString(fmt.Sprintf(`<h%d><a name="%s" class="anchor" href="#%s" rel="nofollow" aria-hidden="true"><span class="octicon octicon-link"></span></a>`, level, anchorName, anchorName))
 	out.WriteString(textHTML)
 	out.WriteString(fmt.Sprintf("</h%d>\n", level))
 }
 
+// uniqueAnchor adds a numeric suffix to repeated anchor names the way
+// GitHub does, so the second "results" heading becomes "results-1"
+func (r *renderer) uniqueAnchor(name string) string {
+	unique := name
+	for i := 1; r.anchors[unique]; i++ {
+		unique = fmt.Sprintf("%s-%d", name, i)
+	}
+	r.anchors[unique] = true
+	return unique
+}
+
+// the paragraph blackfriday produces for a [TOC] line
+var tocMarker = []byte("<p>[TOC]</p>")
+
+// insertTOC replaces the first [TOC] marker in rendered with a table of
+// contents, or if there isn't one and always is set, puts it after the
+// first top level heading
+func insertTOC(rendered []byte, headings []heading, always bool) []byte {
+	at := bytes.Index(rendered, tocMarker)
+	end := at + len(tocMarker)
+	if at == -1 {
+		if !always {
+			return rendered
+		}
+		at, end = 0, 0
+		if h1 := bytes.Index(rendered, []byte("</h1>\n")); h1 != -1 {
+			at, end = h1+len("</h1>\n"), h1+len("</h1>\n")
+		}
+	}
+
+	// the lone h1 is the page title, so leave it out
+	h1s := 0
+	for _, h := range headings {
+		if h.level == 1 {
+			h1s++
+		}
+	}
+	var entries []heading
+	for _, h := range headings {
+		if h.level != 1 || h1s > 1 {
+			entries = append(entries, h)
+		}
+	}
+	if len(entries) == 0 {
+		return append(rendered[:at:at], rendered[end:]...)
+	}
+
+	var toc bytes.Buffer
+	toc.WriteString(`<nav class="toc">`)
+	base := entries[0].level
+	for _, h := range entries {
+		if h.level < base {
+			base = h.level
+		}
+	}
+	depth := 0
+	for i, h := range entries {
+		level := h.level - base + 1
+		if i > 0 && level <= depth {
+			toc.WriteString("</li>")
+		}
+		for ; depth < level; depth++ {
+			toc.WriteString("<ul>")
+			if depth+1 < level {
+				// skipped a level, like an h4 right under an h2
+				toc.WriteString("<li>")
+			}
+		}
+		for ; depth > level; depth-- {
+			toc.WriteString("</ul></li>")
+		}
+		toc.WriteString(`<li><a href="#`)
+		attrEscape(&toc, []byte(h.anchor))
+		toc.WriteString(`">`)
+		attrEscape(&toc, []byte(h.text))
+		toc.WriteString("</a>")
+	}
+	toc.WriteString("</li>")
+	for ; depth > 1; depth-- {
+		toc.WriteString("</ul></li>")
+	}
+	toc.WriteString("</ul></nav>\n")
+
+	out := make([]byte, 0, len(rendered)+toc.Len())
+	out = append(out, rendered[:at]...)
+	out = append(out, toc.Bytes()...)
+	return append(out, rendered[end:]...)
+}
+
 func (r *renderer) Image(out *bytes.Buffer, link []byte, title []byte, alt []byte) {
-	writeImg := func() {
-		out.WriteString("<img src=\"/resize/")
-		leadingSlash := link[0] == '\\'
-		out.WriteString(r.path)
-		if !leadingSlash {
-			out.WriteByte('/')
+	writeImg := func(resize bool) {
+		out.WriteString("<img src=\"")
+		if resize {
+			out.WriteString("/resize/")
+			leadingSlash := link[0] == '\\'
+			out.WriteString(r.path)
+			if !leadingSlash {
+				out.WriteByte('/')
+			}
 		}
 		attrEscape(out, link)
 		out.WriteString("\" alt=\"")
@@ -120,14 +437,18 @@ func (r *renderer) Image(out *bytes.Buffer, link []byte, title []byte, alt []byt
 		attrEscape(out, link)
 		out.WriteString("\" media=\"(min-width: 800px)\">")
 	}
+	switch {
+	// ![x]() is valid CommonMark, but there's nothing to resize
+	case len(link) == 0:
+		writeImg(false)
 	// link to outside of this website
-	if bytes.HasPrefix(link, []byte("http")) {
-		writeImg()
-	} else {
+	case bytes.HasPrefix(link, []byte("http")):
+		writeImg(true)
+	default:
 		// local link; we can use the resized images to support phones
 		out.WriteString("<picture>")
 		writeSource()
-		writeImg()
+		writeImg(true)
 		out.WriteString("</picture>")
 	}
 }
@@ -145,45 +466,108 @@ func extractText(n *html.Node) string {
 	return out
 }
 
-// TODO: Clean up and improve this code.
-// GitHub Flavored Markdown fenced code block with highlighting.
-func (*renderer) BlockCode(out *bytes.Buffer, text []byte, lang string) {
+// extractPageText is like extractText, but separates the text of block
+// level elements with whitespace so words in neighbouring paragraphs,
+// list items and table cells don't run together.
+func extractPageText(n *html.Node) string {
+	var out strings.Builder
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			switch c.Type {
+			case html.TextNode:
+				out.WriteString(c.Data)
+			case html.ElementNode:
+				switch c.Data {
+				case "script", "style":
+					continue
+				case "p", "div", "pre", "li", "ul", "ol", "table", "tr", "td", "th",
+					"blockquote", "br", "h1", "h2", "h3", "h4", "h5", "h6", "hr":
+					out.WriteByte(' ')
+					walk(c)
+					out.WriteByte(' ')
+				default:
+					walk(c)
+				}
+			default:
+				walk(c)
+			}
+		}
+	}
+	walk(n)
+	return strings.Join(strings.Fields(out.String()), " ")
+}
+
+// GitHub Flavored Markdown fenced code block with highlighting. Attributes
+// after the language, like {linenos=true hl_lines=[3,5-7] title="main.c"},
+// add line numbers, highlighted lines and a caption.
+func (r *renderer) BlockCode(out *bytes.Buffer, text []byte, lang string) {
 	doubleSpace(out)
 
-	// parse out the language name
-	count := 0
-	for _, elt := range strings.Fields(lang) {
-		if elt[0] == '.' {
-			elt = elt[1:]
-		}
-		if len(elt) == 0 {
-			continue
-		}
-		out.WriteString(`<div class="highlight highlight-`)
-		attrEscape(out, []byte(elt))
-		lang = elt
-		out.WriteString(`"><pre>`)
-		count++
-		break
+	info := parseFenceInfo(lang)
+	if strings.ToLower(info.lang) == "math" {
+		out.WriteString(`<div class="math">`)
+		out.WriteString(renderMath(string(text), true))
+		out.WriteString("</div>\n")
+		return
+	}
+	if diagram, ok := diagramRendererFor(info.lang); ok {
+		writeDiagram(out, diagram, text, info)
+		return
 	}
 
-	if count == 0 {
-		out.WriteString("<pre><code>")
+	highlightedCode, ok := highlightCode(text, info.lang)
+	if !ok {
+		var buf bytes.Buffer
+		attrEscape(&buf, text)
+		highlightedCode = buf.Bytes()
 	}
 
-	if highlightedCode, ok := highlightCode(text, lang); ok {
-		out.Write(highlightedCode)
-	} else {
-		attrEscape(out, text)
+	if info.fancy() {
+		r.writeFancyCode(out, highlightedCode, info)
+		return
 	}
 
-	if count == 0 {
+	if len(info.lang) == 0 {
+		out.WriteString("<pre><code>")
+		out.Write(highlightedCode)
 		out.WriteString("</code></pre>\n")
+		return
+	}
+	out.WriteString(`<div class="highlight highlight-`)
+	attrEscape(out, []byte(info.lang))
+	out.WriteString(`"><pre>`)
+	out.Write(highlightedCode)
+	out.WriteString("</pre></div>\n")
+}
+
+// GitHub style alerts: a blockquote starting with [!NOTE], [!TIP],
+// [!IMPORTANT], [!WARNING] or [!CAUTION] becomes a callout box.
+func (r *renderer) BlockQuote(out *bytes.Buffer, text []byte) {
+	m := alertMarker.FindSubmatchIndex(text)
+	if m == nil {
+		r.Html.BlockQuote(out, text)
+		return
+	}
+	kind := strings.ToLower(string(text[m[2]:m[3]]))
+	body := text[m[1]:]
+	if string(text[m[4]:m[5]]) == "</p>" {
+		// the marker was the whole paragraph
+		body = bytes.TrimLeft(body, "\n")
 	} else {
-		out.WriteString("</pre></div>\n")
+		body = append([]byte("<p>"), body...)
 	}
+
+	doubleSpace(out)
+	fmt.Fprintf(out, `<div class="markdown-alert markdown-alert-%s">`+"\n", kind)
+	fmt.Fprintf(out, `<p class="markdown-alert-title">%s</p>`+"\n", strings.ToUpper(kind[:1])+kind[1:])
+	out.Write(body)
+	out.WriteString("</div>\n")
 }
 
+// like on GitHub, the marker has to be on a line of its own
+var alertMarker = regexp.MustCompile(`(?i)^<p>\[!(note|tip|important|warning|caution)\][ \t]*(\n|</p>)`)
+
 // Task List support.
 func (r *renderer) ListItem(out *bytes.Buffer, text []byte, flags int) {
 	switch {
@@ -297,7 +681,7 @@ func highlightCode(src []byte, lang string) (highlightedCode []byte, ok bool) {
 		}
 		return out, true
 	default:
-		return nil, false
+		return highlightWithLexer(src, lang)
 	}
 }
 
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSanitizeDirs(t *testing.T) {
+	defer func(old string) { *sanitizeDirs = old }(*sanitizeDirs)
+	*sanitizeDirs = "untrusted, /other/"
+
+	tests := []struct {
+		name     string
+		dir      string
+		markdown string
+		want     []string
+		dontWant []string
+	}{
+		{
+			name:     "script removed",
+			dir:      "untrusted",
+			markdown: "hello <script>alert(1)</script>\n",
+			want:     []string{"hello"},
+			dontWant: []string{"<script", "alert(1)"},
+		},
+		{
+			name:     "script kept outside sanitized dirs",
+			dir:      "mine",
+			markdown: "hello <script>alert(1)</script>\n",
+			want:     []string{"<script>alert(1)</script>"},
+		},
+		{
+			name:     "javascript link removed",
+			dir:      "untrusted/nested",
+			markdown: "[click](javascript:alert(1))\n",
+			want:     []string{"click"},
+			dontWant: []string{"javascript:"},
+		},
+		{
+			name:     "javascript link kept outside sanitized dirs",
+			dir:      "",
+			markdown: "[click](javascript:alert(1))\n",
+			want:     []string{`href="javascript:alert(1)"`},
+		},
+		{
+			name:     "task list",
+			dir:      "other",
+			markdown: "- [ ] todo\n- [x] done\n",
+			want:     []string{`type="checkbox"`, "checked", "todo", "done"},
+		},
+		{
+			name:     "task list outside sanitized dirs",
+			dir:      "mine",
+			markdown: "- [ ] todo\n- [x] done\n",
+			want:     []string{`type="checkbox"`, "checked", "todo", "done"},
+		},
+		{
+			name:     "duplicate heading anchors",
+			dir:      "untrusted",
+			markdown: "# Results\n\n# Results\n",
+			want:     []string{`name="results"`, `href="#results"`, `name="results-1"`, `href="#results-1"`, `class="anchor"`, `aria-hidden="true"`},
+		},
+		{
+			name:     "duplicate heading anchors outside sanitized dirs",
+			dir:      "mine",
+			markdown: "# Results\n\n# Results\n",
+			want:     []string{`name="results"`, `name="results-1"`, `class="anchor"`},
+		},
+		{
+			name:     "responsive image",
+			dir:      "untrusted",
+			markdown: "![a cat](cat.png)\n",
+			want:     []string{"<picture>", `srcset="cat.png"`, `src="/resize/untrusted/cat.png"`, `alt="a cat"`},
+		},
+		{
+			name:     "responsive image outside sanitized dirs",
+			dir:      "mine",
+			markdown: "![a cat](cat.png)\n",
+			want:     []string{"<picture>", `srcset="cat.png"`, `src="/resize/mine/cat.png"`},
+		},
+		{
+			name:     "empty image destination",
+			dir:      "mine",
+			markdown: "![x]() ![y](<>)\n",
+			want:     []string{`<img src="" alt="x" />`, `<img src="" alt="y" />`},
+			dontWant: []string{"<picture>"},
+		},
+		{
+			name:     "javascript srcset removed",
+			dir:      "untrusted",
+			markdown: `<picture><source srcset="javascript:alert(1)"><img src="cat.png"></picture>` + "\n",
+			dontWant: []string{"javascript:"},
+		},
+		{
+			name:     "footnotes",
+			dir:      "untrusted",
+			markdown: "A[^1]\n\n[^1]: x\n",
+			want:     []string{`id="fnref:1"`, `role="doc-noteref"`, `role="doc-endnotes"`, `id="fn:1"`, `role="doc-backlink"`},
+		},
+		{
+			name:     "diagram kept",
+			dir:      "untrusted",
+			markdown: "```mermaid\ngraph LR\n  A --> B\n```\n",
+			want:     []string{"<svg", `xmlns="http://www.w3.org/2000/svg"`, `<marker id="diagram-`, `marker-end="url(#diagram-`, `fill="#57606a"`},
+		},
+		{
+			name:     "svg paint and ids from elsewhere removed",
+			dir:      "untrusted",
+			markdown: `<svg xmlns="http://evil.example/"><rect id="foo" fill="url(https://evil.example/x.svg#a)" stroke="#000"/><path d="M0,0 L1,1" marker-end="url(#foo)" transform="translate(1,2)"/></svg>` + "\n",
+			want:     []string{`stroke="#000"`, `d="M0,0 L1,1"`, `transform="translate(1,2)"`},
+			dontWant: []string{"evil", `id="foo"`, "url(#foo)"},
+		},
+		{
+			name:     "similarly named dir not sanitized",
+			dir:      "untrusted-not",
+			markdown: "<script>alert(1)</script>\n",
+			want:     []string{"<script>"},
+		},
+	}
+
+	for _, test := range tests {
+		got := string(Markdown([]byte(test.markdown), test.dir))
+		for _, want := range test.want {
+			if !strings.Contains(got, want) {
+				t.Errorf("%s: output is missing %q:\n%s", test.name, want, got)
+			}
+		}
+		for _, dontWant := range test.dontWant {
+			if strings.Contains(got, dontWant) {
+				t.Errorf("%s: output contains %q:\n%s", test.name, dontWant, got)
+			}
+		}
+	}
+}
+
+// engines runs f once with each -markdown-engine
+func engines(t *testing.T, f func(t *testing.T, engine string)) {
+	defer func(old string) { *markdownEngine = old }(*markdownEngine)
+	for _, engine := range []string{"commonmark", "blackfriday"} {
+		*markdownEngine = engine
+		f(t, engine)
+	}
+}
+
+func TestFootnotes(t *testing.T) {
+	engines(t, func(t *testing.T, engine string) {
+		got := string(Markdown([]byte("One[^a] and two[^b] and one again[^a].\n\n[^a]: First.\n[^b]: Second.\n"), ""))
+		for _, want := range []string{
+			`<sup id="fnref:1"><a href="#fn:1" class="footnote-ref" role="doc-noteref">1</a></sup>`,
+			`<sup id="fnref:2"><a href="#fn:2" class="footnote-ref" role="doc-noteref">2</a></sup>`,
+			`<sup id="fnref1:1"><a href="#fn:1" class="footnote-ref" role="doc-noteref">1</a></sup>`,
+			`<div class="footnotes" role="doc-endnotes">`,
+			`<li id="fn:1">`,
+			`<li id="fn:2">`,
+			`<a href="#fnref:1" class="footnote-backref" role="doc-backlink">`,
+			`<a href="#fnref1:1" class="footnote-backref" role="doc-backlink">`,
+			`<a href="#fnref:2" class="footnote-backref" role="doc-backlink">`,
+		} {
+			if !strings.Contains(got, want) {
+				t.Errorf("%s: footnotes are missing %q:\n%s", engine, want, got)
+			}
+		}
+	})
+}
+
+func TestFootnotesShareAnchors(t *testing.T) {
+	engines(t, func(t *testing.T, engine string) {
+		// like serveMarkdown rendering several files into one page
+		anchors := make(map[string]bool)
+		docs := []string{
+			"First[^1].\n\n[^1]: One.\n",
+			"No footnotes here.\n",
+			"Second[^1].\n\n[^1]: Two.\n",
+			"Third[^x].\n\n[^x]: Three.\n",
+		}
+		var page string
+		for _, doc := range docs {
+			page += string(renderMarkdown([]byte(doc), "", markdownOptions{anchors: anchors}))
+		}
+		for _, prefix := range []string{"", "1-", "2-"} {
+			for _, want := range []string{
+				`<sup id="` + prefix + `fnref:1"><a href="#` + prefix + `fn:1"`,
+				`<li id="` + prefix + `fn:1">`,
+				`<a href="#` + prefix + `fnref:1" class="footnote-backref"`,
+			} {
+				if strings.Count(page, want) != 1 {
+					t.Errorf("%s: want exactly one %q on the page:\n%s", engine, want, page)
+				}
+			}
+		}
+		if strings.Contains(page, "3-fn:") {
+			t.Errorf("%s: footnote prefix was used up by a document without footnotes:\n%s", engine, page)
+		}
+	})
+}
+
+func TestDefinitionLists(t *testing.T) {
+	engines(t, func(t *testing.T, engine string) {
+		got := string(Markdown([]byte("Term\n: The definition.\n\nOther term\n: Another definition.\n"), ""))
+		for _, want := range []string{"<dl>", "<dt>Term</dt>", "The definition.", "<dt>Other term</dt>", "Another definition.", "</dl>"} {
+			if !strings.Contains(got, want) {
+				t.Errorf("%s: definition list is missing %q:\n%s", engine, want, got)
+			}
+		}
+		if strings.Count(got, "<dd>") != 2 {
+			t.Errorf("%s: want two definitions:\n%s", engine, got)
+		}
+	})
+}
+
+func TestAlerts(t *testing.T) {
+	engines(t, func(t *testing.T, engine string) {
+		tests := []struct {
+			markdown string
+			want     []string
+			dontWant []string
+		}{
+			{
+				markdown: "> [!NOTE]\n> Useful information.\n",
+				want:     []string{`<div class="markdown-alert markdown-alert-note">`, `<p class="markdown-alert-title">Note</p>`, "Useful information."},
+				dontWant: []string{"[!NOTE]", "<blockquote>"},
+			},
+			{
+				markdown: "> [!warning]\n> Be careful.\n>\n> - really\n",
+				want:     []string{`<div class="markdown-alert markdown-alert-warning">`, `<p class="markdown-alert-title">Warning</p>`, "Be careful.", "<li>really</li>"},
+				dontWant: []string{"[!warning]", "<blockquote>"},
+			},
+			{
+				markdown: "> [!NOTE]\n",
+				want:     []string{`<div class="markdown-alert markdown-alert-note">`, `<p class="markdown-alert-title">Note</p>`},
+				dontWant: []string{"[!NOTE]", "<blockquote>"},
+			},
+			{
+				markdown: "> [!WARNING] Be careful.\n",
+				want:     []string{"<blockquote>", "[!WARNING] Be careful."},
+				dontWant: []string{"markdown-alert"},
+			},
+			{
+				markdown: "> [!NOPE]\n> Not an alert.\n",
+				want:     []string{"<blockquote>", "[!NOPE]"},
+				dontWant: []string{"markdown-alert"},
+			},
+			{
+				markdown: "> Just a quote mentioning [!NOTE].\n",
+				want:     []string{"<blockquote>"},
+				dontWant: []string{"markdown-alert"},
+			},
+		}
+		for _, test := range tests {
+			got := string(Markdown([]byte(test.markdown), ""))
+			for _, want := range test.want {
+				if !strings.Contains(got, want) {
+					t.Errorf("%s: %q is missing %q:\n%s", engine, test.markdown, want, got)
+				}
+			}
+			for _, dontWant := range test.dontWant {
+				if strings.Contains(got, dontWant) {
+					t.Errorf("%s: %q contains %q:\n%s", engine, test.markdown, dontWant, got)
+				}
+			}
+		}
+	})
+}
+
+func TestCodeBlockIDsLeaveHeadingsAlone(t *testing.T) {
+	engines(t, func(t *testing.T, engine string) {
+		md := "```go {linenos=true}\nx := 1\n```\n\n" +
+			"```go {title=\"Code\"}\ny := 2\n```\n\n" +
+			"```go {hl_lines=1}\nz := 3\n```\n\n" +
+			"## Code\n\n## Code 1\n"
+		got := string(Markdown([]byte(md), ""))
+		for _, want := range []string{
+			`<figure class="code-block" id="code:1">`,
+			`id="code:1-L1"`,
+			`href="#code:1-L1"`,
+			`<figure class="code-block" id="code:code">`,
+			`<figure class="code-block" id="code:2">`,
+			`name="code"`,
+			`name="code-1"`,
+		} {
+			if !strings.Contains(got, want) {
+				t.Errorf("%s: output is missing %q:\n%s", engine, want, got)
+			}
+		}
+		if strings.Contains(got, `name="code-2"`) {
+			t.Errorf("%s: code blocks pushed a heading's anchor along:\n%s", engine, got)
+		}
+	})
+}
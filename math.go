@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bytes"
+	"html"
+	"net/url"
+	"regexp"
+	"strconv"
+)
+
+// Math in Markdown is pulled out before blackfriday sees it, so _ and * in
+// TeX aren't taken for emphasis, and put back into the rendered HTML as
+// MathML. Dollar signs follow pandoc's rules so prices don't turn into
+// math: the opening $ can't be followed by a space, and the closing $
+// can't follow a space or be followed by a digit. Code spans and code
+// blocks are left alone, and \$ is always a literal dollar sign. So are
+// link destinations and titles, URLs and HTML tags, where MathML can't go.
+
+// placeholders are made of control characters blackfriday passes through
+// untouched and nobody writes in Markdown
+const mathPlaceholderMark = "\x1a"
+
+var mathPlaceholder = regexp.MustCompile(`(<p>)?` + mathPlaceholderMark + `math(\d+)` + mathPlaceholderMark + `(</p>\n?)?`)
+
+// placeholders the renderer percent encoded, when math ended up in a URL
+var escapedMathPlaceholder = regexp.MustCompile(`(?i)%1Amath(\d+)%1A`)
+
+type mathSpan struct {
+	tex     string
+	display bool
+}
+
+// source returns the math as it was written in the Markdown
+func (s mathSpan) source() string {
+	if s.display {
+		return "$$" + s.tex + "$$"
+	}
+	return "$" + s.tex + "$"
+}
+
+var (
+	// link reference definitions, like [id]: http://example.com "title"
+	linkDefinition = regexp.MustCompile(`^ {0,3}\[[^\]]+\]:`)
+	// autolinks and HTML tags, whose attributes can hold dollar signs
+	autolinkOrTag = regexp.MustCompile(`^<(?:[A-Za-z][A-Za-z0-9+.-]{1,31}:[^\s<>]*>|/?[A-Za-z][A-Za-z0-9-]*(?:[\s/][^<>]*)?>)`)
+	// bare URLs, which get linked automatically
+	bareURL = regexp.MustCompile(`^(?:https?://|www\.)[^\s<]*`)
+)
+
+// extractMath replaces the math in text with placeholders
+func extractMath(text []byte) ([]byte, []mathSpan) {
+	if bytes.IndexByte(text, '$') == -1 {
+		return text, nil
+	}
+
+	var out bytes.Buffer
+	var spans []mathSpan
+	placeholder := func(tex string, display bool) {
+		out.WriteString(mathPlaceholderMark + "math" + strconv.Itoa(len(spans)) + mathPlaceholderMark)
+		spans = append(spans, mathSpan{tex, display})
+	}
+
+	lines := bytes.SplitAfter(text, []byte("\n"))
+	var fence []byte
+	prevBlank := true
+	inIndentedCode := false
+	for li := 0; li < len(lines); li++ {
+		line := lines[li]
+		trimmed := bytes.TrimLeft(line, " ")
+		indent := len(line) - len(trimmed)
+		blank := len(bytes.TrimSpace(line)) == 0
+
+		// fenced code blocks, including ```math ones, which BlockCode renders
+		if fence != nil {
+			out.Write(line)
+			if indent < 4 && bytes.HasPrefix(trimmed, fence) && len(bytes.TrimSpace(bytes.TrimLeft(trimmed, string(fence[:1])))) == 0 {
+				fence = nil
+			}
+			continue
+		}
+		if indent < 4 && (bytes.HasPrefix(trimmed, []byte("```")) || bytes.HasPrefix(trimmed, []byte("~~~"))) {
+			n := 0
+			for n < len(trimmed) && trimmed[n] == trimmed[0] {
+				n++
+			}
+			fence = trimmed[:n]
+			out.Write(line)
+			continue
+		}
+		// indented code blocks
+		if (indent >= 4 || bytes.HasPrefix(line, []byte("\t"))) && !blank && (prevBlank || inIndentedCode) {
+			inIndentedCode = true
+			out.Write(line)
+			continue
+		}
+		inIndentedCode = inIndentedCode && blank
+		prevBlank = blank
+
+		// gather the rest of the paragraph, since math can span lines but
+		// not paragraphs
+		para := line
+		for !blank && li+1 < len(lines) {
+			next := lines[li+1]
+			nextTrimmed := bytes.TrimLeft(next, " ")
+			if len(bytes.TrimSpace(next)) == 0 || bytes.HasPrefix(nextTrimmed, []byte("```")) || bytes.HasPrefix(nextTrimmed, []byte("~~~")) {
+				break
+			}
+			para = append(para[:len(para):len(para)], next...)
+			li++
+		}
+		if linkDefinition.Match(para) {
+			out.Write(para)
+			continue
+		}
+		extractInlineMath(&out, para, placeholder)
+	}
+	return out.Bytes(), spans
+}
+
+// extractInlineMath copies a paragraph to out, replacing math with placeholders
+func extractInlineMath(out *bytes.Buffer, para []byte, placeholder func(string, bool)) {
+	for i := 0; i < len(para); {
+		c := para[i]
+		switch {
+		case c == '\\' && i+1 < len(para) && para[i+1] == '$':
+			out.WriteByte('$')
+			i += 2
+			continue
+		case c == '\\' && i+1 < len(para):
+			// keep other escapes, like \`, intact
+			out.Write(para[i : i+2])
+			i += 2
+			continue
+		case c == '`':
+			// copy code spans as they are
+			n := 0
+			for i+n < len(para) && para[i+n] == '`' {
+				n++
+			}
+			run := para[i : i+n]
+			end := i + n
+			for end < len(para) {
+				next := bytes.Index(para[end:], run)
+				if next == -1 {
+					end = -1
+					break
+				}
+				end += next
+				m := 0
+				for end+m < len(para) && para[end+m] == '`' {
+					m++
+				}
+				if m == n {
+					end += n
+					break
+				}
+				end += m
+			}
+			if end == -1 || end > len(para) {
+				out.Write(run)
+				i += n
+			} else {
+				out.Write(para[i:end])
+				i = end
+			}
+			continue
+		case c == ']' && i+1 < len(para) && para[i+1] == '(':
+			// link and image destinations and titles
+			if end := linkDestinationEnd(para, i+1); end != -1 {
+				out.Write(para[i:end])
+				i = end
+				continue
+			}
+		case c == '<':
+			if m := autolinkOrTag.Find(para[i:]); m != nil {
+				out.Write(m)
+				i += len(m)
+				continue
+			}
+		case (c == 'h' || c == 'w') && (i == 0 || isSpaceByte(para[i-1]) || para[i-1] == '('):
+			if m := bareURL.Find(para[i:]); m != nil {
+				out.Write(m)
+				i += len(m)
+				continue
+			}
+		case c == '$' && i+1 < len(para) && para[i+1] == '$':
+			if end := bytes.Index(para[i+2:], []byte("$$")); end > 0 {
+				tex := bytes.TrimSpace(para[i+2 : i+2+end])
+				if len(tex) > 0 {
+					placeholder(string(tex), true)
+					i += end + 4
+					continue
+				}
+			}
+			out.WriteString("$$")
+			i += 2
+			continue
+		case c == '$':
+			if end := closingDollar(para, i+1); end != -1 {
+				placeholder(string(para[i+1:end]), false)
+				i = end + 1
+				continue
+			}
+		}
+		out.WriteByte(c)
+		i++
+	}
+}
+
+// linkDestinationEnd returns the index just past the ) closing the link
+// destination and title that start with the ( at open, or -1 if it's
+// never closed
+func linkDestinationEnd(para []byte, open int) int {
+	depth := 0
+	var quote byte
+	for i := open; i < len(para); i++ {
+		c := para[i]
+		switch {
+		case c == '\\':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case (c == '"' || c == '\'') && isSpaceByte(para[i-1]):
+			quote = c
+		case c == '<' && i == open+1:
+			// <destination with spaces>
+			end := bytes.IndexByte(para[i:], '>')
+			if end == -1 {
+				return -1
+			}
+			i += end
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+			if depth == 0 {
+				return i + 1
+			}
+		}
+	}
+	return -1
+}
+
+// closingDollar finds the $ closing inline math opened just before start,
+// or returns -1 if there isn't one
+func closingDollar(para []byte, start int) int {
+	if start >= len(para) || isSpaceByte(para[start]) || para[start] == '$' {
+		return -1
+	}
+	for i := start; i < len(para); i++ {
+		switch para[i] {
+		case '\\':
+			i++
+		case '`':
+			// a code span starts before anything closes
+			return -1
+		case '$':
+			if isSpaceByte(para[i-1]) {
+				// "$5 and $10" - the second $ opens, it doesn't close
+				return -1
+			}
+			if i+1 < len(para) && '0' <= para[i+1] && para[i+1] <= '9' {
+				return -1
+			}
+			return i
+		}
+	}
+	return -1
+}
+
+func isSpaceByte(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+// restoreMath swaps the placeholders in rendered HTML for MathML; display
+// math alone in a paragraph replaces the paragraph. Math that ended up in
+// an attribute, like an image's alt text, is put back as escaped TeX.
+func restoreMath(rendered []byte, spans []mathSpan) []byte {
+	if len(spans) == 0 {
+		return rendered
+	}
+	span := func(num []byte) (mathSpan, bool) {
+		n, err := strconv.Atoi(string(num))
+		if err != nil || n >= len(spans) {
+			return mathSpan{}, false
+		}
+		return spans[n], true
+	}
+	rendered = escapedMathPlaceholder.ReplaceAllFunc(rendered, func(m []byte) []byte {
+		s, ok := span(escapedMathPlaceholder.FindSubmatch(m)[1])
+		if !ok {
+			return m
+		}
+		return []byte(url.PathEscape(s.source()))
+	})
+
+	var out bytes.Buffer
+	last := 0
+	for _, loc := range mathPlaceholder.FindAllSubmatchIndex(rendered, -1) {
+		out.Write(rendered[last:loc[0]])
+		last = loc[1]
+		m := rendered[loc[0]:loc[1]]
+		s, ok := span(rendered[loc[4]:loc[5]])
+		if !ok {
+			out.Write(m)
+			continue
+		}
+		opened, closed := loc[2] != -1, loc[6] != -1
+		switch {
+		case !opened && inTag(rendered[:loc[0]]):
+			out.WriteString(html.EscapeString(s.source()))
+			if closed {
+				out.Write(rendered[loc[6]:loc[7]])
+			}
+		case opened && closed && s.display:
+			out.WriteString(`<div class="math">` + renderMath(s.tex, true) + "</div>\n")
+		case opened && closed:
+			out.WriteString("<p>" + renderMath(s.tex, false) + "</p>\n")
+		default:
+			if opened {
+				out.WriteString("<p>")
+			}
+			out.WriteString(renderMath(s.tex, s.display))
+			if closed {
+				out.Write(rendered[loc[6]:loc[7]])
+			}
+		}
+	}
+	out.Write(rendered[last:])
+	return out.Bytes()
+}
+
+// inTag reports whether the end of before is inside an HTML tag, since
+// rendered text and attribute values have their < and > escaped
+func inTag(before []byte) bool {
+	return bytes.LastIndexByte(before, '<') > bytes.LastIndexByte(before, '>')
+}
+
+// renderMath converts TeX to MathML, falling back to showing the source
+// when it can't be converted
+func renderMath(tex string, display bool) string {
+	math, err := TeXToMathML(tex, display)
+	if err != nil {
+		return `<code class="math-error" title="` + html.EscapeString(err.Error()) + `">` + html.EscapeString(tex) + `</code>`
+	}
+	return math
+}
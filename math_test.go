@@ -0,0 +1,36 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMathOutsideAttributes(t *testing.T) {
+	defer func(old string) { *markdownEngine = old }(*markdownEngine)
+
+	tests := []struct {
+		markdown string
+		want     []string
+	}{
+		{"[see](http://example.com/$a$b) and $x$\n", []string{`href="http://example.com/$a$b"`, "<math"}},
+		{"![alt $x$](p.png \"t $y$\")\n", []string{`alt="alt $x$"`, `title="t $y$"`}},
+		{"![$$z$$](p.png)\n", []string{`alt="$$z$$"`}},
+		{"[r]\n\n[r]: http://example.com/$a$b \"$t$\"\n", []string{`href="http://example.com/$a$b"`, `title="$t$"`}},
+		{"<http://example.com/$a$b> and http://example.com/$c$d\n", []string{`href="http://example.com/$a$b"`, `href="http://example.com/$c$d"`}},
+		{"<span title=\"$a$\">$b$</span>\n", []string{`title="$a$"`, "<math"}},
+	}
+	for _, engine := range []string{"commonmark", "blackfriday"} {
+		*markdownEngine = engine
+		for _, test := range tests {
+			got := string(Markdown([]byte(test.markdown), ""))
+			if strings.Contains(got, mathPlaceholderMark) || strings.Contains(strings.ToLower(got), "%1amath") {
+				t.Errorf("%s: %q left a placeholder behind:\n%s", engine, test.markdown, got)
+			}
+			for _, want := range test.want {
+				if !strings.Contains(got, want) {
+					t.Errorf("%s: %q is missing %q:\n%s", engine, test.markdown, want, got)
+				}
+			}
+		}
+	}
+}
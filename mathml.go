@@ -0,0 +1,704 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// a small TeX to MathML converter covering the parts of LaTeX math people
+// actually use in writeups: scripts, fractions, roots, accents, fonts,
+// delimiters, matrices and the usual symbols
+
+var errMathBraces = errors.New("unbalanced braces")
+
+// identifiers, drawn in italics unless they're uppercase Greek
+var mathIdentifiers = map[string]string{
+	"alpha": "α", "beta": "β", "gamma": "γ", "delta": "δ", "epsilon": "ϵ",
+	"varepsilon": "ε", "zeta": "ζ", "eta": "η", "theta": "θ", "vartheta": "ϑ",
+	"iota": "ι", "kappa": "κ", "lambda": "λ", "mu": "μ", "nu": "ν", "xi": "ξ",
+	"pi": "π", "varpi": "ϖ", "rho": "ρ", "varrho": "ϱ", "sigma": "σ",
+	"varsigma": "ς", "tau": "τ", "upsilon": "υ", "phi": "ϕ", "varphi": "φ",
+	"chi": "χ", "psi": "ψ", "omega": "ω",
+	"infty": "∞", "partial": "∂", "nabla": "∇", "hbar": "ℏ", "ell": "ℓ",
+	"aleph": "ℵ", "emptyset": "∅", "varnothing": "∅", "Re": "ℜ", "Im": "ℑ",
+}
+
+var mathUprightIdentifiers = map[string]string{
+	"Gamma": "Γ", "Delta": "Δ", "Theta": "Θ", "Lambda": "Λ", "Xi": "Ξ",
+	"Pi": "Π", "Sigma": "Σ", "Upsilon": "Υ", "Phi": "Φ", "Psi": "Ψ", "Omega": "Ω",
+}
+
+var mathOperators = map[string]string{
+	"pm": "±", "mp": "∓", "times": "×", "div": "÷", "cdot": "⋅", "ast": "∗",
+	"star": "⋆", "circ": "∘", "bullet": "∙", "oplus": "⊕", "otimes": "⊗",
+	"le": "≤", "leq": "≤", "ge": "≥", "geq": "≥", "ne": "≠", "neq": "≠",
+	"approx": "≈", "equiv": "≡", "sim": "∼", "simeq": "≃", "cong": "≅",
+	"propto": "∝", "ll": "≪", "gg": "≫", "in": "∈", "notin": "∉", "ni": "∋",
+	"subset": "⊂", "subseteq": "⊆", "supset": "⊃", "supseteq": "⊇",
+	"cup": "∪", "cap": "∩", "setminus": "∖", "wedge": "∧", "land": "∧",
+	"vee": "∨", "lor": "∨", "neg": "¬", "lnot": "¬", "forall": "∀",
+	"exists": "∃", "to": "→", "rightarrow": "→", "leftarrow": "←", "gets": "←",
+	"leftrightarrow": "↔", "Rightarrow": "⇒", "Leftarrow": "⇐",
+	"Leftrightarrow": "⇔", "iff": "⟺", "implies": "⟹", "mapsto": "↦",
+	"uparrow": "↑", "downarrow": "↓", "ldots": "…", "dots": "…", "cdots": "⋯",
+	"vdots": "⋮", "ddots": "⋱", "langle": "⟨", "rangle": "⟩", "lfloor": "⌊",
+	"rfloor": "⌋", "lceil": "⌈", "rceil": "⌉", "vert": "|", "lvert": "|",
+	"rvert": "|", "Vert": "‖", "lVert": "‖", "rVert": "‖", "mid": "∣",
+	"parallel": "∥", "perp": "⊥", "angle": "∠", "triangle": "△", "prime": "′",
+	"dagger": "†", "lbrace": "{", "rbrace": "}", "colon": ":",
+	"{": "{", "}": "}", "|": "‖", "$": "$", "%": "%", "#": "#", "&": "&", "_": "_",
+}
+
+// operators with limits drawn above and below in display math
+var mathLimitOperators = map[string]string{
+	"sum": "∑", "prod": "∏", "coprod": "∐", "bigcup": "⋃", "bigcap": "⋂",
+	"bigoplus": "⨁", "bigotimes": "⨂",
+	"lim": "lim", "max": "max", "min": "min", "sup": "sup", "inf": "inf",
+	"det": "det", "gcd": "gcd", "liminf": "lim inf", "limsup": "lim sup",
+}
+
+// integrals take their limits as scripts
+var mathIntegrals = map[string]string{
+	"int": "∫", "iint": "∬", "iiint": "∭", "oint": "∮",
+}
+
+var mathFunctions = map[string]bool{
+	"sin": true, "cos": true, "tan": true, "sec": true, "csc": true, "cot": true,
+	"arcsin": true, "arccos": true, "arctan": true, "sinh": true, "cosh": true,
+	"tanh": true, "log": true, "ln": true, "lg": true, "exp": true, "dim": true,
+	"ker": true, "arg": true, "deg": true, "hom": true, "Pr": true,
+}
+
+var mathSpaces = map[string]string{
+	",": "0.167em", ":": "0.222em", ">": "0.222em", ";": "0.278em", " ": "0.333em",
+	"quad": "1em", "qquad": "2em", "!": "-0.167em",
+}
+
+// accents over (or under) their argument
+var mathAccents = map[string]string{
+	"hat": "^", "widehat": "^", "bar": "¯", "overline": "¯", "vec": "→",
+	"dot": "˙", "ddot": "¨", "tilde": "~", "widetilde": "~", "check": "ˇ",
+	"breve": "˘", "acute": "´", "grave": "`",
+}
+
+// matrix environments and the delimiters around them
+var mathMatrices = map[string][2]string{
+	"matrix": {"", ""}, "smallmatrix": {"", ""}, "pmatrix": {"(", ")"},
+	"bmatrix": {"[", "]"}, "Bmatrix": {"{", "}"}, "vmatrix": {"|", "|"},
+	"Vmatrix": {"‖", "‖"}, "cases": {"{", ""},
+}
+
+var mathAlignments = map[string]bool{
+	"aligned": true, "align": true, "align*": true, "split": true,
+	"gathered": true, "gather": true, "gather*": true, "array": true,
+}
+
+// TeXToMathML converts a TeX math expression into a MathML <math> element,
+// with the source kept in an annotation
+func TeXToMathML(tex string, display bool) (string, error) {
+	p := &mathParser{src: tex, display: display}
+	nodes, err := p.parseList()
+	if err != nil {
+		return "", err
+	}
+	if p.pos < len(p.src) {
+		return "", fmt.Errorf("unexpected %q", p.rest(10))
+	}
+
+	var b strings.Builder
+	b.WriteString(`<math`)
+	if display {
+		b.WriteString(` display="block"`)
+	}
+	b.WriteString(`><semantics>`)
+	b.WriteString(mrow(nodes))
+	b.WriteString(`<annotation encoding="application/x-tex">`)
+	b.WriteString(html.EscapeString(tex))
+	b.WriteString(`</annotation></semantics></math>`)
+	return b.String(), nil
+}
+
+type mathParser struct {
+	src     string
+	pos     int
+	display bool
+}
+
+func mrow(nodes []string) string {
+	if len(nodes) == 1 {
+		return nodes[0]
+	}
+	return "<mrow>" + strings.Join(nodes, "") + "</mrow>"
+}
+
+func mathElement(tag, text string) string {
+	return "<" + tag + ">" + html.EscapeString(text) + "</" + tag + ">"
+}
+
+func (p *mathParser) rest(n int) string {
+	s := p.src[p.pos:]
+	if len(s) > n {
+		s = s[:n]
+	}
+	return s
+}
+
+func (p *mathParser) skipSpace() {
+	for p.pos < len(p.src) && strings.IndexByte(" \t\r\n", p.src[p.pos]) != -1 {
+		p.pos++
+	}
+}
+
+// atCommand reports whether the next token is the command \name
+func (p *mathParser) atCommand(name string) bool {
+	s := p.src[p.pos:]
+	if !strings.HasPrefix(s, `\`+name) {
+		return false
+	}
+	s = s[len(name)+1:]
+	return len(s) == 0 || !isMathLetter(s[0])
+}
+
+func isMathLetter(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+// atListEnd reports whether the next token ends the current list
+func (p *mathParser) atListEnd() bool {
+	if p.pos >= len(p.src) {
+		return true
+	}
+	switch p.src[p.pos] {
+	case '}', '&':
+		return true
+	}
+	return strings.HasPrefix(p.src[p.pos:], `\\`) || p.atCommand("right") || p.atCommand("end")
+}
+
+// parseList parses nodes up to the end of the input, a closing brace, a
+// matrix separator, \right or \end, which are left for the caller
+func (p *mathParser) parseList() ([]string, error) {
+	var nodes []string
+	for {
+		p.skipSpace()
+		if p.atListEnd() {
+			return nodes, nil
+		}
+		node, err := p.parseScripted()
+		if err != nil {
+			return nil, err
+		}
+		if len(node) > 0 {
+			nodes = append(nodes, node)
+		}
+	}
+}
+
+// parseGroup parses a braced group, starting at the opening brace
+func (p *mathParser) parseGroup() (string, error) {
+	p.pos++
+	nodes, err := p.parseList()
+	if err != nil {
+		return "", err
+	}
+	if p.pos >= len(p.src) || p.src[p.pos] != '}' {
+		return "", errMathBraces
+	}
+	p.pos++
+	if len(nodes) == 0 {
+		return "<mrow></mrow>", nil
+	}
+	return mrow(nodes), nil
+}
+
+// parseScripted parses a node with any sub and superscripts attached to it
+func (p *mathParser) parseScripted() (string, error) {
+	base, limits, err := p.parsePrimary()
+	if err != nil {
+		return "", err
+	}
+	var sub, sup string
+	for {
+		p.skipSpace()
+		if p.pos >= len(p.src) {
+			break
+		}
+		c := p.src[p.pos]
+		if c == '\'' {
+			// primes are superscripts too
+			p.pos++
+			sup += "<mo>′</mo>"
+			continue
+		}
+		if c != '^' && c != '_' {
+			break
+		}
+		p.pos++
+		arg, err := p.parseArgument()
+		if err != nil {
+			return "", err
+		}
+		if c == '^' {
+			sup += arg
+		} else {
+			sub += arg
+		}
+	}
+	if len(sub) == 0 && len(sup) == 0 {
+		return base, nil
+	}
+	if len(base) == 0 {
+		base = "<mrow></mrow>"
+	}
+
+	under, over := "msub", "msup"
+	both := "msubsup"
+	if limits {
+		under, over, both = "munder", "mover", "munderover"
+	}
+	switch {
+	case len(sup) == 0:
+		return "<" + under + ">" + base + sub + "</" + under + ">", nil
+	case len(sub) == 0:
+		return "<" + over + ">" + base + sup + "</" + over + ">", nil
+	}
+	return "<" + both + ">" + base + sub + sup + "</" + both + ">", nil
+}
+
+// parseArgument parses the argument of a command or script: a group or a
+// single token
+func (p *mathParser) parseArgument() (string, error) {
+	p.skipSpace()
+	if p.pos >= len(p.src) {
+		return "", errors.New("missing argument")
+	}
+	if p.src[p.pos] == '{' {
+		return p.parseGroup()
+	}
+	if p.atListEnd() {
+		return "", fmt.Errorf("missing argument before %q", p.rest(10))
+	}
+	node, _, err := p.parsePrimary()
+	return node, err
+}
+
+// rawArgument returns the unparsed text of a braced argument
+func (p *mathParser) rawArgument() (string, error) {
+	p.skipSpace()
+	if p.pos >= len(p.src) || p.src[p.pos] != '{' {
+		return p.rawToken(), nil
+	}
+	depth := 0
+	for i := p.pos; i < len(p.src); i++ {
+		switch p.src[i] {
+		case '\\':
+			i++
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				arg := p.src[p.pos+1 : i]
+				p.pos = i + 1
+				return arg, nil
+			}
+		}
+	}
+	return "", errMathBraces
+}
+
+// rawToken returns the next character or command unparsed
+func (p *mathParser) rawToken() string {
+	start := p.pos
+	if p.pos < len(p.src) && p.src[p.pos] == '\\' {
+		p.pos++
+		p.readCommandName()
+		return p.src[start:p.pos]
+	}
+	_, size := utf8.DecodeRuneInString(p.src[p.pos:])
+	p.pos += size
+	return p.src[start:p.pos]
+}
+
+func (p *mathParser) readCommandName() string {
+	start := p.pos
+	for p.pos < len(p.src) && isMathLetter(p.src[p.pos]) {
+		p.pos++
+	}
+	if p.pos == start && p.pos < len(p.src) {
+		_, size := utf8.DecodeRuneInString(p.src[p.pos:])
+		p.pos += size
+	}
+	// starred environments and commands
+	if p.pos < len(p.src) && p.src[p.pos] == '*' && p.pos > start && isMathLetter(p.src[start]) {
+		p.pos++
+	}
+	return p.src[start:p.pos]
+}
+
+// parsePrimary parses a single node, reporting whether it takes limits
+func (p *mathParser) parsePrimary() (node string, limits bool, err error) {
+	c := p.src[p.pos]
+	switch {
+	case c == '{':
+		node, err = p.parseGroup()
+		return node, false, err
+	case c == '\\':
+		p.pos++
+		return p.parseCommand(p.readCommandName())
+	case c == '^' || c == '_':
+		// scripts with nothing to attach to
+		return "", false, nil
+	case '0' <= c && c <= '9' || c == '.' && p.pos+1 < len(p.src) && '0' <= p.src[p.pos+1] && p.src[p.pos+1] <= '9':
+		start := p.pos
+		for p.pos < len(p.src) && ('0' <= p.src[p.pos] && p.src[p.pos] <= '9' ||
+			p.src[p.pos] == '.' && p.pos+1 < len(p.src) && '0' <= p.src[p.pos+1] && p.src[p.pos+1] <= '9') {
+			p.pos++
+		}
+		return mathElement("mn", p.src[start:p.pos]), false, nil
+	case c == '~':
+		p.pos++
+		return `<mspace width="0.333em"/>`, false, nil
+	}
+
+	r, size := utf8.DecodeRuneInString(p.src[p.pos:])
+	p.pos += size
+	if unicode.IsLetter(r) {
+		return mathElement("mi", string(r)), false, nil
+	}
+	if r == '-' {
+		r = '−'
+	}
+	return mathElement("mo", string(r)), false, nil
+}
+
+func (p *mathParser) parseCommand(name string) (string, bool, error) {
+	if s, ok := mathIdentifiers[name]; ok {
+		return mathElement("mi", s), false, nil
+	}
+	if s, ok := mathUprightIdentifiers[name]; ok {
+		return `<mi mathvariant="normal">` + s + `</mi>`, false, nil
+	}
+	if s, ok := mathOperators[name]; ok {
+		return mathElement("mo", s), false, nil
+	}
+	if s, ok := mathLimitOperators[name]; ok {
+		return `<mo movablelimits="true">` + s + `</mo>`, true, nil
+	}
+	if s, ok := mathIntegrals[name]; ok {
+		return mathElement("mo", s), false, nil
+	}
+	if mathFunctions[name] {
+		return mathElement("mi", name), false, nil
+	}
+	if width, ok := mathSpaces[name]; ok {
+		return `<mspace width="` + width + `"/>`, false, nil
+	}
+	if accent, ok := mathAccents[name]; ok {
+		arg, err := p.parseArgument()
+		if err != nil {
+			return "", false, err
+		}
+		stretchy := "false"
+		if strings.HasPrefix(name, "wide") || name == "overline" {
+			stretchy = "true"
+		}
+		return `<mover accent="true">` + arg + `<mo stretchy="` + stretchy + `">` + html.EscapeString(accent) + `</mo></mover>`, false, nil
+	}
+
+	switch name {
+	case "frac", "dfrac", "tfrac", "cfrac":
+		num, err := p.parseArgument()
+		if err != nil {
+			return "", false, err
+		}
+		den, err := p.parseArgument()
+		if err != nil {
+			return "", false, err
+		}
+		node := "<mfrac>" + num + den + "</mfrac>"
+		switch name {
+		case "dfrac", "cfrac":
+			node = `<mstyle displaystyle="true">` + node + `</mstyle>`
+		case "tfrac":
+			node = `<mstyle displaystyle="false">` + node + `</mstyle>`
+		}
+		return node, false, nil
+	case "binom":
+		top, err := p.parseArgument()
+		if err != nil {
+			return "", false, err
+		}
+		bottom, err := p.parseArgument()
+		if err != nil {
+			return "", false, err
+		}
+		return `<mrow><mo>(</mo><mfrac linethickness="0">` + top + bottom + `</mfrac><mo>)</mo></mrow>`, false, nil
+	case "sqrt":
+		p.skipSpace()
+		var index string
+		if p.pos < len(p.src) && p.src[p.pos] == '[' {
+			end := strings.IndexByte(p.src[p.pos:], ']')
+			if end == -1 {
+				return "", false, errors.New("unclosed root index")
+			}
+			sub := &mathParser{src: p.src[p.pos+1 : p.pos+end], display: p.display}
+			nodes, err := sub.parseList()
+			if err != nil {
+				return "", false, err
+			}
+			index = mrow(nodes)
+			p.pos += end + 1
+		}
+		arg, err := p.parseArgument()
+		if err != nil {
+			return "", false, err
+		}
+		if len(index) > 0 {
+			return "<mroot>" + arg + index + "</mroot>", false, nil
+		}
+		return "<msqrt>" + arg + "</msqrt>", false, nil
+	case "underline":
+		arg, err := p.parseArgument()
+		if err != nil {
+			return "", false, err
+		}
+		return `<munder accentunder="true">` + arg + `<mo stretchy="true">_</mo></munder>`, false, nil
+	case "overbrace", "underbrace":
+		arg, err := p.parseArgument()
+		if err != nil {
+			return "", false, err
+		}
+		if name == "overbrace" {
+			return `<mover>` + arg + `<mo stretchy="true">⏞</mo></mover>`, true, nil
+		}
+		return `<munder>` + arg + `<mo stretchy="true">⏟</mo></munder>`, true, nil
+	case "text", "textrm", "textit", "textbf", "mbox", "hbox":
+		text, err := p.rawArgument()
+		if err != nil {
+			return "", false, err
+		}
+		return mathElement("mtext", text), false, nil
+	case "operatorname", "mathrm":
+		text, err := p.rawArgument()
+		if err != nil {
+			return "", false, err
+		}
+		return `<mi mathvariant="normal">` + html.EscapeString(strings.TrimSpace(text)) + `</mi>`, false, nil
+	case "mathbf", "boldsymbol", "bm", "mathbb", "mathcal", "mathscr", "mathfrak", "mathsf", "mathtt":
+		text, err := p.rawArgument()
+		if err != nil {
+			return "", false, err
+		}
+		return styledMath(name, text), false, nil
+	case "mathit":
+		return p.parseArgumentNode()
+	case "left", "right", "bigl", "bigr", "Bigl", "Bigr", "biggl", "biggr", "Biggl", "Biggr", "big", "Big", "bigg", "Bigg":
+		if name == "left" {
+			return p.parseFenced()
+		}
+		delim, err := p.parseDelimiter()
+		return delim, false, err
+	case "begin":
+		return p.parseEnvironment()
+	case "displaystyle":
+		nodes, err := p.parseList()
+		if err != nil {
+			return "", false, err
+		}
+		return `<mstyle displaystyle="true">` + mrow(nodes) + `</mstyle>`, false, nil
+	case "limits", "nolimits":
+		return "", false, nil
+	}
+	return `<merror><mtext>\` + html.EscapeString(name) + `</mtext></merror>`, false, nil
+}
+
+func (p *mathParser) parseArgumentNode() (string, bool, error) {
+	node, err := p.parseArgument()
+	return node, false, err
+}
+
+// parseDelimiter parses the delimiter after \left, \right or \big
+func (p *mathParser) parseDelimiter() (string, error) {
+	p.skipSpace()
+	if p.pos >= len(p.src) {
+		return "", errors.New("missing delimiter")
+	}
+	tok := p.rawToken()
+	if tok == "." {
+		return "", nil
+	}
+	if strings.HasPrefix(tok, `\`) {
+		s, ok := mathOperators[tok[1:]]
+		if !ok {
+			return "", fmt.Errorf("unknown delimiter %q", tok)
+		}
+		tok = s
+	}
+	return `<mo fence="true" stretchy="true">` + html.EscapeString(tok) + `</mo>`, nil
+}
+
+// parseFenced parses \left( ... \right), after the \left
+func (p *mathParser) parseFenced() (string, bool, error) {
+	open, err := p.parseDelimiter()
+	if err != nil {
+		return "", false, err
+	}
+	nodes, err := p.parseList()
+	if err != nil {
+		return "", false, err
+	}
+	if !p.atCommand("right") {
+		return "", false, errors.New(`\left without \right`)
+	}
+	p.pos += len(`\right`)
+	close, err := p.parseDelimiter()
+	if err != nil {
+		return "", false, err
+	}
+	return "<mrow>" + open + strings.Join(nodes, "") + close + "</mrow>", false, nil
+}
+
+// parseEnvironment parses \begin{env} ... \end{env}, after the \begin
+func (p *mathParser) parseEnvironment() (string, bool, error) {
+	env, err := p.rawArgument()
+	if err != nil {
+		return "", false, err
+	}
+	delims, isMatrix := mathMatrices[env]
+	if !isMatrix && !mathAlignments[env] {
+		return "", false, fmt.Errorf("unknown environment %q", env)
+	}
+	if env == "array" {
+		// the column spec
+		if _, err := p.rawArgument(); err != nil {
+			return "", false, err
+		}
+	}
+
+	var rows []string
+	var cells []string
+	for {
+		nodes, err := p.parseList()
+		if err != nil {
+			return "", false, err
+		}
+		cells = append(cells, "<mtd>"+mrow(nodes)+"</mtd>")
+		switch {
+		case p.pos >= len(p.src):
+			return "", false, fmt.Errorf(`missing \end{%s}`, env)
+		case p.src[p.pos] == '&':
+			p.pos++
+			continue
+		case strings.HasPrefix(p.src[p.pos:], `\\`):
+			p.pos += 2
+			rows = append(rows, "<mtr>"+strings.Join(cells, "")+"</mtr>")
+			cells = nil
+			continue
+		case p.atCommand("end"):
+			p.pos += len(`\end`)
+			end, err := p.rawArgument()
+			if err != nil {
+				return "", false, err
+			}
+			if end != env {
+				return "", false, fmt.Errorf(`\begin{%s} ended by \end{%s}`, env, end)
+			}
+		default:
+			return "", false, fmt.Errorf("unexpected %q in %s", p.rest(10), env)
+		}
+		break
+	}
+	// a trailing \\ leaves an empty last row
+	if len(cells) > 1 || len(cells) == 1 && cells[0] != "<mtd><mrow></mrow></mtd>" {
+		rows = append(rows, "<mtr>"+strings.Join(cells, "")+"</mtr>")
+	}
+
+	table := "<mtable>"
+	switch {
+	case env == "cases":
+		table = `<mtable columnalign="left left">`
+	case !isMatrix && env != "array" && !strings.HasPrefix(env, "gather"):
+		table = `<mtable columnalign="right left" columnspacing="0">`
+	}
+	table += strings.Join(rows, "") + "</mtable>"
+	if len(delims[0]) == 0 && len(delims[1]) == 0 {
+		return table, false, nil
+	}
+	node := "<mrow>"
+	if len(delims[0]) > 0 {
+		node += `<mo fence="true" stretchy="true">` + html.EscapeString(delims[0]) + `</mo>`
+	}
+	node += table
+	if len(delims[1]) > 0 {
+		node += `<mo fence="true" stretchy="true">` + html.EscapeString(delims[1]) + `</mo>`
+	}
+	return node + "</mrow>", false, nil
+}
+
+// styledMath writes text in one of the math alphabets, using the Unicode
+// mathematical alphanumeric symbols since browsers only reliably support
+// mathvariant="normal"
+func styledMath(command, text string) string {
+	var b strings.Builder
+	for _, r := range text {
+		if unicode.IsSpace(r) {
+			continue
+		}
+		s := styledRune(command, r)
+		if unicode.IsDigit(r) {
+			b.WriteString("<mn>" + html.EscapeString(s) + "</mn>")
+		} else {
+			b.WriteString("<mi>" + html.EscapeString(s) + "</mi>")
+		}
+	}
+	if b.Len() == 0 {
+		return "<mrow></mrow>"
+	}
+	return "<mrow>" + b.String() + "</mrow>"
+}
+
+// letters that were in Unicode before the mathematical alphanumeric block,
+// and so are missing from it
+var styledExceptions = map[string]map[rune]rune{
+	"mathbb": {'C': 'ℂ', 'H': 'ℍ', 'N': 'ℕ', 'P': 'ℙ', 'Q': 'ℚ', 'R': 'ℝ', 'Z': 'ℤ'},
+	"mathcal": {'B': 'ℬ', 'E': 'ℰ', 'F': 'ℱ', 'H': 'ℋ', 'I': 'ℐ', 'L': 'ℒ', 'M': 'ℳ', 'R': 'ℛ',
+		'e': 'ℯ', 'g': 'ℊ', 'o': 'ℴ'},
+	"mathfrak": {'C': 'ℭ', 'H': 'ℌ', 'I': 'ℑ', 'R': 'ℜ', 'Z': 'ℨ'},
+}
+
+// start of the capital letters, small letters and digits of each alphabet
+var styledAlphabets = map[string][3]rune{
+	"mathbf":   {0x1D400, 0x1D41A, 0x1D7CE},
+	"mathbb":   {0x1D538, 0x1D552, 0x1D7D8},
+	"mathcal":  {0x1D49C, 0x1D4B6, 0},
+	"mathfrak": {0x1D504, 0x1D51E, 0},
+	"mathsf":   {0x1D5A0, 0x1D5BA, 0x1D7E2},
+	"mathtt":   {0x1D670, 0x1D68A, 0x1D7F6},
+}
+
+func styledRune(command string, r rune) string {
+	switch command {
+	case "boldsymbol", "bm":
+		command = "mathbf"
+	case "mathscr":
+		command = "mathcal"
+	}
+	if e, ok := styledExceptions[command][r]; ok {
+		return string(e)
+	}
+	starts := styledAlphabets[command]
+	switch {
+	case 'A' <= r && r <= 'Z':
+		return string(starts[0] + r - 'A')
+	case 'a' <= r && r <= 'z':
+		return string(starts[1] + r - 'a')
+	case '0' <= r && r <= '9' && starts[2] != 0:
+		return string(starts[2] + r - '0')
+	}
+	return string(r)
+}
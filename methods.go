@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Methods restricts h to the given request methods. HEAD is allowed
+// wherever GET is, OPTIONS is answered with the list of allowed methods,
+// and anything else gets a 405 with an Allow header.
+func Methods(h http.Handler, methods ...string) http.Handler {
+	allowed := make(map[string]bool)
+	var names []string
+	for _, m := range methods {
+		allowed[m] = true
+		names = append(names, m)
+		if m == "GET" && !allowed["HEAD"] {
+			allowed["HEAD"] = true
+			names = append(names, "HEAD")
+		}
+	}
+	names = append(names, "OPTIONS")
+	allow := strings.Join(names, ", ")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "OPTIONS":
+			w.Header().Set("Allow", allow)
+			w.Header().Set("Content-Length", "0")
+			w.WriteHeader(204)
+		case allowed[r.Method]:
+			h.ServeHTTP(w, r)
+		default:
+			w.Header().Set("Allow", allow)
+			serveError(w, r, 405, "")
+		}
+	})
+}
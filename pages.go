@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// SitePage is a Markdown page under static/
+type SitePage struct {
+	// URL path of the page
+	Path string
+	File string
+	Meta FrontMatter
+	// the Markdown without its front matter
+	Body []byte
+}
+
+// error pages like 404.md aren't pages of their own
+var errorPageName = regexp.MustCompile(`^\d{3}\.md$`)
+
+// sitePages returns every Markdown page under static/ that isn't hidden by
+// the -deny patterns, including drafts
+func sitePages() ([]SitePage, error) {
+	var pages []SitePage
+	err := filepath.Walk(STATIC_DIR, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if file == STATIC_DIR {
+			return nil
+		}
+		urlPath := "/" + filepath.ToSlash(file[len(STATIC_DIR+"/"):])
+		if isHidden(urlPath) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() || !strings.HasSuffix(file, ".md") || errorPageName.MatchString(info.Name()) {
+			return nil
+		}
+
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		meta, body, err := ParseFrontMatter(b)
+		if err != nil {
+			// still list it; serving it will show the error
+			body = b
+		}
+		if urlPath == "/intro.md" {
+			urlPath = "/"
+		}
+		pages = append(pages, SitePage{Path: urlPath, File: file, Meta: meta, Body: body})
+		return nil
+	})
+	return pages, err
+}
@@ -14,18 +14,23 @@ func Resize(maxWidth uint, h http.Handler) http.Handler {
 	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
 		rc := ResponseCollector{}
 		req := *r
+		// the image has to be read to know the resized response, even for HEAD
+		req.Method = "GET"
 		h.ServeHTTP(&rc, &req)
 		imageResp := rc.CollectResponse()
 
-		if imageResp.Code != 200 {
+		if imageResp.Code >= 400 {
+			// replace http.FileServer's plain text errors with the site's
+			serveError(rw, r, imageResp.Code, "")
+			return
+		} else if imageResp.Code != 200 {
 			imageResp.WriteResponse(rw)
 			return
 		}
 
 		typ, hasType := imageResp.Headers["Content-Type"]
 		if !hasType || len(typ) == 0 {
-			rw.WriteHeader(501)
-			rw.Write([]byte("could not determine content type of image"))
+			serveError(rw, r, 500, "could not determine content type of image")
 			return
 		}
 
@@ -35,16 +40,16 @@ func Resize(maxWidth uint, h http.Handler) http.Handler {
 		case "image/png":
 			image, err := png.Decode(buf)
 			if err != nil {
-				rw.WriteHeader(501)
-				rw.Write([]byte("error while decoding png: " + err.Error()))
+				log.Printf("[ERR] unable to decode png %s: %v", r.URL.Path, err)
+				serveError(rw, r, 500, "")
 				return
 			}
 			resizedImage := resize.Thumbnail(maxWidth, 100000, image, resize.NearestNeighbor)
 			resizedBuf := new(bytes.Buffer)
 			encoder := png.Encoder{CompressionLevel: png.BestCompression}
 			if encodeErr := encoder.Encode(resizedBuf, resizedImage); encodeErr != nil {
-				rw.WriteHeader(501)
-				rw.Write([]byte("error while encoding png: " + err.Error()))
+				log.Printf("[ERR] unable to encode png %s: %v", r.URL.Path, encodeErr)
+				serveError(rw, r, 500, "")
 				return
 			}
 			rw.Header().Add("Content-Type", "image/png")
@@ -52,8 +57,8 @@ func Resize(maxWidth uint, h http.Handler) http.Handler {
 		case "image/jpeg":
 			image, err := jpeg.Decode(buf)
 			if err != nil {
-				rw.WriteHeader(501)
-				rw.Write([]byte("error while decoding jpeg: " + err.Error()))
+				log.Printf("[ERR] unable to decode jpeg %s: %v", r.URL.Path, err)
+				serveError(rw, r, 500, "")
 				return
 			}
 			log.Println("resizing ", r.URL.String(), "(", image.Bounds().Max.X, ") to ", maxWidth)
@@ -61,20 +66,18 @@ func Resize(maxWidth uint, h http.Handler) http.Handler {
 			resizedBuf := new(bytes.Buffer)
 			jpegOptions := jpeg.Options{Quality: 75}
 			if encodeErr := jpeg.Encode(resizedBuf, resizedImage, &jpegOptions); encodeErr != nil {
-				rw.WriteHeader(501)
-				rw.Write([]byte("error while encoding jpeg: " + err.Error()))
+				log.Printf("[ERR] unable to encode jpeg %s: %v", r.URL.Path, encodeErr)
+				serveError(rw, r, 500, "")
 				return
 			}
 			rw.Header().Add("Content-Type", "image/jpeg")
 			log.Println("resized size: ", resizedBuf.Len())
 			rw.Write(resizedBuf.Bytes())
 		case "text/html":
-			rw.WriteHeader(415)
-			rw.Write([]byte("can't resize html files"))
+			serveError(rw, r, 415, "can't resize html files")
 			return
 		default:
-			rw.WriteHeader(501)
-			rw.Write([]byte("unimplemented"))
+			serveError(rw, r, 501, "can't resize "+typ[0]+" files")
 			return
 		}
 	})
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"html"
+	"html/template"
+	"log"
+	"math"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	nethtml "golang.org/x/net/html"
+)
+
+const MAX_SEARCH_RESULTS = 50
+
+type searchDoc struct {
+	Path  string
+	Title string
+	Text  string
+	// number of terms in the document, for normalizing term frequencies
+	Length int
+}
+
+type posting struct {
+	doc   int
+	count int
+}
+
+// SearchIndex is an inverted index over the text of every published page
+type SearchIndex struct {
+	mu       sync.RWMutex
+	docs     []searchDoc
+	postings map[string][]posting
+	titles   map[string][]int
+	// set by Invalidate, for the next search to rebuild the index
+	stale bool
+}
+
+var searchIndex = &SearchIndex{}
+
+// SearchResult is one ranked match for a query
+type SearchResult struct {
+	Path    string  `json:"path"`
+	URL     string  `json:"url"`
+	Title   string  `json:"title"`
+	Score   float64 `json:"score"`
+	Snippet string  `json:"snippet"`
+	// the snippet with matching words wrapped in <mark>
+	SnippetHTML template.HTML `json:"snippet_html"`
+}
+
+// tokenize splits text into lowercase words
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// Rebuild re-reads every page under static/ and replaces the index
+func (idx *SearchIndex) Rebuild() {
+	start := time.Now()
+	pages, err := sitePages()
+	if err != nil {
+		log.Printf("[ERR] unable to build search index: %v", err)
+		return
+	}
+
+	var docs []searchDoc
+	postings := make(map[string][]posting)
+	titles := make(map[string][]int)
+	for _, page := range pages {
+		if page.Meta.Draft {
+			continue
+		}
+		dir := strings.TrimPrefix(path.Dir(page.Path), "/")
+		rendered := Markdown(page.Body, dir)
+		node, err := nethtml.Parse(bytes.NewReader(rendered))
+		if err != nil {
+			continue
+		}
+		text := extractPageText(node)
+		title := page.Meta.Title
+		if len(title) == 0 {
+			title = markdownTitle(page.Body)
+		}
+		if len(title) == 0 {
+			title = page.Path
+		}
+
+		id := len(docs)
+		counts := make(map[string]int)
+		terms := tokenize(text)
+		for _, term := range terms {
+			counts[term]++
+		}
+		for term, count := range counts {
+			postings[term] = append(postings[term], posting{id, count})
+		}
+		seen := make(map[string]bool)
+		for _, term := range tokenize(title) {
+			if !seen[term] {
+				titles[term] = append(titles[term], id)
+				seen[term] = true
+			}
+		}
+		docs = append(docs, searchDoc{Path: page.Path, Title: title, Text: text, Length: len(terms)})
+	}
+
+	idx.mu.Lock()
+	idx.docs, idx.postings, idx.titles = docs, postings, titles
+	idx.mu.Unlock()
+	log.Printf("indexed %d pages for search in %v", len(docs), time.Since(start))
+}
+
+// Invalidate marks the index as out of date, so the next search rebuilds
+// it first
+func (idx *SearchIndex) Invalidate() {
+	idx.mu.Lock()
+	idx.stale = true
+	idx.mu.Unlock()
+}
+
+// Search ranks the indexed pages against query using TF-IDF, favouring
+// pages that contain every term and pages with the terms in their titles
+func (idx *SearchIndex) Search(query string) []SearchResult {
+	terms := tokenize(query)
+	if len(terms) == 0 {
+		return nil
+	}
+
+	idx.mu.Lock()
+	stale := idx.stale
+	idx.stale = false
+	idx.mu.Unlock()
+	if stale {
+		idx.Rebuild()
+	}
+
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	scores := make(map[int]float64)
+	matched := make(map[int]int)
+	n := float64(len(idx.docs))
+	for _, term := range uniqueStrings(terms) {
+		ps := idx.postings[term]
+		if len(ps) == 0 {
+			continue
+		}
+		idf := math.Log(1 + n/float64(len(ps)))
+		for _, p := range ps {
+			tf := float64(p.count) / math.Sqrt(float64(idx.docs[p.doc].Length)+1)
+			scores[p.doc] += tf * idf
+			matched[p.doc]++
+		}
+		for _, doc := range idx.titles[term] {
+			scores[doc] += 2 * idf
+		}
+	}
+
+	results := make([]SearchResult, 0, len(scores))
+	for doc, score := range scores {
+		// pages missing some of the terms drop well below ones with all of them
+		coverage := float64(matched[doc]) / float64(len(uniqueStrings(terms)))
+		d := idx.docs[doc]
+		snippet, snippetHTML := makeSnippet(d.Text, terms)
+		results = append(results, SearchResult{
+			Path:        d.Path,
+			URL:         pageURL(d.Path),
+			Title:       d.Title,
+			Score:       score * coverage * coverage,
+			Snippet:     snippet,
+			SnippetHTML: snippetHTML,
+		})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score == results[j].Score {
+			return results[i].Path < results[j].Path
+		}
+		return results[i].Score > results[j].Score
+	})
+	if len(results) > MAX_SEARCH_RESULTS {
+		results = results[:MAX_SEARCH_RESULTS]
+	}
+	return results
+}
+
+func uniqueStrings(ss []string) []string {
+	seen := make(map[string]bool)
+	var ret []string
+	for _, s := range ss {
+		if !seen[s] {
+			seen[s] = true
+			ret = append(ret, s)
+		}
+	}
+	return ret
+}
+
+// makeSnippet cuts a window of text around the first matching word, and
+// returns it both plain and as HTML with the matching words highlighted
+func makeSnippet(text string, terms []string) (string, template.HTML) {
+	const before, after = 60, 180
+
+	isTerm := make(map[string]bool)
+	for _, t := range terms {
+		isTerm[t] = true
+	}
+
+	// find the word boundaries in text
+	type word struct{ start, end int }
+	var words []word
+	start := -1
+	for i, r := range text {
+		inWord := unicode.IsLetter(r) || unicode.IsNumber(r)
+		if inWord && start == -1 {
+			start = i
+		} else if !inWord && start != -1 {
+			words = append(words, word{start, i})
+			start = -1
+		}
+	}
+	if start != -1 {
+		words = append(words, word{start, len(text)})
+	}
+
+	first := 0
+	for _, w := range words {
+		if isTerm[strings.ToLower(text[w.start:w.end])] {
+			first = w.start
+			break
+		}
+	}
+	lo, hi := first-before, first+after
+	if lo < 0 {
+		lo = 0
+	}
+	if hi > len(text) {
+		hi = len(text)
+	}
+	// don't cut words or runes in half
+	for lo > 0 {
+		r, size := utf8.DecodeLastRuneInString(text[:lo])
+		if unicode.IsSpace(r) {
+			break
+		}
+		lo -= size
+	}
+	for hi < len(text) {
+		r, size := utf8.DecodeRuneInString(text[hi:])
+		if unicode.IsSpace(r) {
+			break
+		}
+		hi += size
+	}
+
+	var plain strings.Builder
+	var marked strings.Builder
+	if lo > 0 {
+		plain.WriteString("… ")
+		marked.WriteString("… ")
+	}
+	last := lo
+	for _, w := range words {
+		if w.start < lo || w.end > hi {
+			continue
+		}
+		if isTerm[strings.ToLower(text[w.start:w.end])] {
+			marked.WriteString(html.EscapeString(text[last:w.start]))
+			marked.WriteString("<mark>" + html.EscapeString(text[w.start:w.end]) + "</mark>")
+			last = w.end
+		}
+	}
+	marked.WriteString(html.EscapeString(text[last:hi]))
+	plain.WriteString(text[lo:hi])
+	if hi < len(text) {
+		plain.WriteString(" …")
+		marked.WriteString(" …")
+	}
+	return plain.String(), template.HTML(marked.String())
+}
+
+// SearchHandler serves ranked results for the q parameter, as an HTML page
+// or, for /search.json and clients asking for JSON, as a JSON list
+func SearchHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query().Get("q")
+	results := searchIndex.Search(query)
+
+	if strings.HasSuffix(r.URL.Path, ".json") || wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		resp := struct {
+			Query   string         `json:"query"`
+			Results []SearchResult `json:"results"`
+		}{query, results}
+		if resp.Results == nil {
+			resp.Results = []SearchResult{}
+		}
+		json.NewEncoder(w).Encode(&resp)
+		return
+	}
+
+	var content strings.Builder
+	content.WriteString("<h1>Search</h1>\n")
+	content.WriteString(`<form class="search-form" action="/search" method="get">`)
+	content.WriteString(`<input type="search" name="q" value="` + html.EscapeString(query) + `" placeholder="Search the site">`)
+	content.WriteString(`<button type="submit">Search</button></form>` + "\n")
+	if len(strings.TrimSpace(query)) > 0 {
+		if len(results) == 0 {
+			content.WriteString("<p>No pages matched <strong>" + html.EscapeString(query) + "</strong>.</p>\n")
+		}
+		content.WriteString(`<ol class="search-results">` + "\n")
+		for _, result := range results {
+			content.WriteString(`<li><a href="` + html.EscapeString(result.Path) + `">` + html.EscapeString(result.Title) + "</a>")
+			content.WriteString(`<p class="search-snippet">` + string(result.SnippetHTML) + "</p></li>\n")
+		}
+		content.WriteString("</ol>\n")
+	}
+
+	title := "Search"
+	if len(query) > 0 {
+		title = query + " | Search"
+	}
+	renderPage(w, r, 200, Page{Title: title, Content: template.HTML(content.String())})
+}
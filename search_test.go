@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestMakeSnippetKeepsRunesWhole(t *testing.T) {
+	// à is C3 A0 and Å is C3 85, whose second bytes are spaces in Latin-1
+	for pad := 0; pad < 24; pad++ {
+		// move the cuts on either side across every byte of the words there
+		text := strings.Repeat("làbas ", 20) + strings.Repeat("x", pad) + " match " + strings.Repeat("y", pad) + " " + strings.Repeat("Ångström ", 40)
+		plain, marked := makeSnippet(text, []string{"match"})
+		if !utf8.ValidString(plain) || !utf8.ValidString(string(marked)) {
+			t.Fatalf("pad %d: snippet isn't valid UTF-8:\n%q\n%q", pad, plain, marked)
+		}
+		if !strings.Contains(string(marked), "<mark>match</mark>") {
+			t.Errorf("pad %d: match isn't highlighted: %q", pad, marked)
+		}
+		inner := strings.TrimSuffix(strings.TrimPrefix(plain, "… "), " …")
+		for _, word := range strings.Fields(inner) {
+			if word != "làbas" && word != "match" && word != "Ångström" && strings.Trim(word, "xy") != "" {
+				t.Errorf("pad %d: snippet cuts a word in half: %q in %q", pad, word, plain)
+			}
+		}
+	}
+}
+
+func TestSearchEscapesURLs(t *testing.T) {
+	testSite(t, map[string]string{
+		"notes/my page.md": "# My page\n\nAbout aardvarks.\n",
+	})
+	idx := &SearchIndex{}
+	idx.Rebuild()
+	results := idx.Search("aardvarks")
+	if len(results) != 1 {
+		t.Fatalf("got %d results, want 1: %+v", len(results), results)
+	}
+	if want := "https://" + DOMAIN_NAME + "/notes/my%20page.md"; results[0].URL != want {
+		t.Errorf("URL = %q, want %q", results[0].URL, want)
+	}
+	if results[0].Path != "/notes/my page.md" {
+		t.Errorf("Path = %q, want the unescaped path", results[0].Path)
+	}
+}
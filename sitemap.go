@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+var robotsFile = flag.String("robots", "robots.txt", "file with extra robots.txt rules appended to the generated ones")
+
+type sitemapURL struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 urlset"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+// Sitemap lists every published page on the site, plus the blog index
+func Sitemap() ([]byte, error) {
+	pages, err := sitePages()
+	if err != nil {
+		return nil, err
+	}
+
+	var set sitemapURLSet
+	for _, page := range pages {
+		if page.Meta.Draft {
+			continue
+		}
+		updated := page.Meta.Updated
+		if updated.IsZero() {
+			updated = lastModified(page.File)
+		}
+		u := sitemapURL{Loc: pageURL(page.Path)}
+		if !updated.IsZero() {
+			u.LastMod = updated.Format(time.RFC3339)
+		}
+		set.URLs = append(set.URLs, u)
+	}
+	if posts := blog.Posts(); len(posts) > 0 {
+		set.URLs = append(set.URLs, sitemapURL{
+			Loc:     pageURL("/" + strings.Trim(*blogDir, "/") + "/"),
+			LastMod: feedUpdated(posts).Format(time.RFC3339),
+		})
+	}
+	return marshalXML(set)
+}
+
+// Robots generates robots.txt: everything is allowed, the rules from
+// -robots are added after, and the sitemap is linked at the end. Drafts
+// aren't listed, since that would publish their URLs; they 404 anyway.
+func Robots() ([]byte, error) {
+	var buf bytes.Buffer
+	// an empty Disallow allows everything
+	buf.WriteString("User-agent: *\nDisallow:\n")
+
+	if b, err := ioutil.ReadFile(*robotsFile); err == nil {
+		buf.WriteString("\n")
+		buf.Write(bytes.TrimSpace(b))
+		buf.WriteString("\n")
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	fmt.Fprintf(&buf, "\nSitemap: %s\n", siteURL("/sitemap.xml"))
+	return buf.Bytes(), nil
+}
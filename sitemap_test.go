@@ -0,0 +1,68 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testSite makes a static/ directory holding files, maps of paths to
+// contents, in a temporary directory and runs the rest of the test there
+func testSite(t *testing.T, files map[string]string) {
+	dir := t.TempDir()
+	for name, content := range files {
+		file := filepath.Join(dir, STATIC_DIR, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	blog.Invalidate()
+	t.Cleanup(func() {
+		os.Chdir(wd)
+		blog.Invalidate()
+	})
+}
+
+func TestSitemapEscapesPaths(t *testing.T) {
+	testSite(t, map[string]string{
+		"intro.md":             "# Home\n",
+		"notes/my page.md":     "# My page\n",
+		"notes/what?#now.md":   "# What now\n",
+		"notes/café.md":        "# Café\n",
+		"notes/draft page.md":  "---\ndraft: true\n---\n# Draft\n",
+		"blog/2020-01-01-a.md": "# A post\n",
+	})
+
+	b, err := Sitemap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := string(b)
+	for _, want := range []string{
+		"<loc>https://" + DOMAIN_NAME + "/</loc>",
+		"<loc>https://" + DOMAIN_NAME + "/notes/my%20page.md</loc>",
+		"<loc>https://" + DOMAIN_NAME + "/notes/what%3F%23now.md</loc>",
+		"<loc>https://" + DOMAIN_NAME + "/notes/caf%C3%A9.md</loc>",
+		"<loc>https://" + DOMAIN_NAME + "/blog/</loc>",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("sitemap is missing %s:\n%s", want, got)
+		}
+	}
+	for _, dontWant := range []string{"my page", "draft", "café"} {
+		if strings.Contains(got, dontWant) {
+			t.Errorf("sitemap contains %q:\n%s", dontWant, got)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+var (
+	tlsMinVersion   = flag.String("tls-min-version", "1.2", "minimum TLS version to accept (1.0, 1.1, 1.2 or 1.3)")
+	tlsCipherSuites = flag.String("tls-ciphers", "", "comma separated list of TLS 1.0-1.2 cipher suites to allow; empty uses the hardened default set")
+	tlsCurves       = flag.String("tls-curves", "X25519,P256,P384", "comma separated list of elliptic curves to allow, in order of preference")
+	ocspStapling    = flag.Bool("ocsp-stapling", true, "fetch and staple OCSP responses to the TLS handshake")
+
+	hstsMaxAge            = flag.Duration("hsts-max-age", 365*24*time.Hour, "max-age of the Strict-Transport-Security header; 0 disables HSTS")
+	hstsIncludeSubdomains = flag.Bool("hsts-include-subdomains", true, "add includeSubDomains to the Strict-Transport-Security header")
+	hstsPreload           = flag.Bool("hsts-preload", false, "add preload to the Strict-Transport-Security header")
+
+	redirectCode = flag.Int("redirect-code", http.StatusMovedPermanently, "status code the HTTP server uses to redirect to HTTPS (301, 302, 307 or 308)")
+)
+
+const CERT_FILE = "/etc/letsencrypt/live/" + DOMAIN_NAME + "/fullchain.pem"
+const KEY_FILE = "/etc/letsencrypt/live/" + DOMAIN_NAME + "/privkey.pem"
+
+// only AEAD suites with forward secrecy; TLS 1.3 suites aren't configurable
+var defaultCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCurveIDs = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+}
+
+// TLSConfig builds the server's TLS policy from the command line flags.
+// Certificates are served from a certStore so renewals and OCSP staples
+// are picked up without restarting the server.
+func TLSConfig(certs *certStore) (*tls.Config, error) {
+	minVersion, ok := tlsVersions[*tlsMinVersion]
+	if !ok {
+		return nil, fmt.Errorf("unknown TLS version %q", *tlsMinVersion)
+	}
+
+	ciphers := defaultCipherSuites
+	if len(*tlsCipherSuites) > 0 {
+		ciphers = nil
+		for _, name := range splitList(*tlsCipherSuites) {
+			id, err := cipherSuiteID(name)
+			if err != nil {
+				return nil, err
+			}
+			ciphers = append(ciphers, id)
+		}
+	}
+
+	var curves []tls.CurveID
+	for _, name := range splitList(*tlsCurves) {
+		id, ok := tlsCurveIDs[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown elliptic curve %q", name)
+		}
+		curves = append(curves, id)
+	}
+
+	return &tls.Config{
+		MinVersion:       minVersion,
+		CipherSuites:     ciphers,
+		CurvePreferences: curves,
+		GetCertificate:   certs.GetCertificate,
+		NextProtos:       []string{"h2", "http/1.1"},
+	}, nil
+}
+
+func cipherSuiteID(name string) (uint16, error) {
+	for _, suite := range tls.CipherSuites() {
+		if suite.Name == name {
+			return suite.ID, nil
+		}
+	}
+	for _, suite := range tls.InsecureCipherSuites() {
+		if suite.Name == name {
+			return 0, fmt.Errorf("cipher suite %s is insecure", name)
+		}
+	}
+	return 0, fmt.Errorf("unknown cipher suite %q", name)
+}
+
+func splitList(s string) []string {
+	var ret []string
+	for _, elt := range strings.Split(s, ",") {
+		if elt = strings.TrimSpace(elt); len(elt) > 0 {
+			ret = append(ret, elt)
+		}
+	}
+	return ret
+}
+
+// certStore holds the current certificate and reloads it from disk
+// periodically, refreshing the stapled OCSP response along the way
+type certStore struct {
+	certFile, keyFile string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+func NewCertStore(certFile, keyFile string) (*certStore, error) {
+	c := &certStore{certFile: certFile, keyFile: keyFile}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *certStore) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+func (c *certStore) reload() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return err
+	}
+	if *ocspStapling {
+		if staple, err := fetchOCSP(&cert); err != nil {
+			// keep serving without a staple rather than failing the handshake
+			log.Printf("[ERR] unable to fetch OCSP response: %v", err)
+		} else {
+			cert.OCSPStaple = staple
+		}
+	}
+
+	c.mu.Lock()
+	c.cert = &cert
+	c.mu.Unlock()
+	return nil
+}
+
+// Refresh reloads the certificate every interval until the server shuts down
+func (c *certStore) Refresh(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.reload(); err != nil {
+				log.Printf("[ERR] unable to reload certificate: %v", err)
+			}
+		case <-serverShutdown:
+			return
+		}
+	}
+}
+
+func fetchOCSP(cert *tls.Certificate) ([]byte, error) {
+	if len(cert.Leaf.OCSPServer) == 0 {
+		return nil, errors.New("certificate has no OCSP server")
+	}
+	if len(cert.Certificate) < 2 {
+		return nil, errors.New("certificate chain is missing the issuer")
+	}
+	issuer, err := x509.ParseCertificate(cert.Certificate[1])
+	if err != nil {
+		return nil, err
+	}
+	req, err := ocsp.CreateRequest(cert.Leaf, issuer, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(cert.Leaf.OCSPServer[0], "application/ocsp-request", bytes.NewReader(req))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("OCSP server returned %s", resp.Status)
+	}
+	raw, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	parsed, err := ocsp.ParseResponseForCert(raw, cert.Leaf, issuer)
+	if err != nil {
+		return nil, err
+	}
+	if parsed.Status != ocsp.Good {
+		return nil, fmt.Errorf("OCSP status for certificate is %d", parsed.Status)
+	}
+	return raw, nil
+}
+
+// HSTS adds a Strict-Transport-Security header to every response sent over TLS
+func HSTS(next http.Handler) http.Handler {
+	if *hstsMaxAge <= 0 {
+		return next
+	}
+	value := "max-age=" + strconv.FormatInt(int64(hstsMaxAge.Seconds()), 10)
+	if *hstsIncludeSubdomains {
+		value += "; includeSubDomains"
+	}
+	if *hstsPreload {
+		value += "; preload"
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil {
+			w.Header().Set("Strict-Transport-Security", value)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func checkRedirectCode(code int) error {
+	switch code {
+	case http.StatusMovedPermanently, http.StatusFound,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return nil
+	}
+	return fmt.Errorf("invalid redirect status code %d", code)
+}